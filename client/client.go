@@ -1,6 +1,8 @@
 package client
 
 import (
+    "crypto/rand"
+    "encoding/binary"
     "fmt"
     "net"
     "bufio"
@@ -40,6 +42,8 @@ type Client struct {
     reader           *bufio.Reader  // A bufio Reader wrapper over conn
     ServerList       []string       // List of server addrs to which client can send requests. 0th server is null
     lock             sync.Mutex     // Mutex to access conn and reader
+    sessionId        int64          // Random id with which servers recognise the retries of this client's requests
+    seq              int64          // Sequence number of the last write, cas or delete
 }
 
 
@@ -53,13 +57,27 @@ func New(config *raft_config.Config, id int) *Client {
                             Id          : id,
                             ServerList  : config.ServerList,
                             conn        : nil,
-                            reader      : nil}
+                            reader      : nil,
+                            sessionId   : newSessionId()}
     if ! client.setupConnectionToServer() {
         return nil
     }
     return &client
 }
 
+/***
+ *  Generate random non-zero session id, unique across the clients of the cluster
+ */
+func newSessionId() int64 {
+    var buf [8]byte
+    for {
+        rand.Read(buf[:])
+        if id := int64(binary.BigEndian.Uint64(buf[:]) >> 1); id != 0 {
+            return id
+        }
+    }
+}
+
 /***
  *  Establish connection to any reachable server
  *
@@ -131,7 +149,7 @@ func (cl *Client) rcv() (msg *fs.Msg, err error) {
         return nil, fatalerr
     }
 
-    if msg.Kind == 'C' {                            // Read contents
+    if msg.Kind == 'C' || msg.Kind == 'L' {         // Read contents
         contents := make([]byte, msg.Numbytes)
         var c byte
         for i := 0; i < msg.Numbytes; i++ {
@@ -145,6 +163,26 @@ func (cl *Client) rcv() (msg *fs.Msg, err error) {
             cl.reader.ReadByte() // \r
             cl.reader.ReadByte() // \n
         }
+    } else if msg.Kind == 'S' || msg.Kind == 'H' {  // Read entries of scan or history
+        for i := range msg.Entries {
+            if line, err = cl.reader.ReadString('\n'); err != nil {
+                break
+            }
+            if msg.Entries[i], err = fs.ParseEntry(line); err != nil {
+                break
+            }
+        }
+    } else if msg.Kind == 'Y' {                     // Read responses to the ops of txn
+        for i := range msg.Responses {
+            if line, err = cl.reader.ReadString('\n'); err != nil {
+                break
+            }
+            var r *fs.Msg
+            if r, _, err = fs.PaserString(line); err != nil {
+                break
+            }
+            msg.Responses[i] = *r
+        }
     }
     return msg, err
 }
@@ -228,33 +266,235 @@ func (cl *Client) Read(filename string) (*fs.Msg, error) {
     return cl.sendRcv(cmd)
 }
 
+// Read file in given mode, fs.READ_STALE or fs.READ_LINEARIZABLE
+func (cl *Client) ReadMode(filename string, mode string) (*fs.Msg, error) {
+    cmd := "read " + filename + " " + mode + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// Read the version of the file, which may be a past one kept in its history
+func (cl *Client) ReadVersion(filename string, version int) (*fs.Msg, error) {
+    cmd := fmt.Sprintf("read %s %d\r\n", filename, version)
+    return cl.sendRcv(cmd)
+}
+
+// Read length bytes of the file from the offset, up to its end if length is 0
+func (cl *Client) ReadRange(filename string, offset int, length int) (*fs.Msg, error) {
+    cmd := fmt.Sprintf("read %s %d %d\r\n", filename, offset, length)
+    return cl.sendRcv(cmd)
+}
+
+// Metadata of the file, in msg.Stat of the response
+func (cl *Client) Stat(filename string) (*fs.Msg, error) {
+    cmd := "stat " + filename + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// List the versions of the file kept, latest first, as the entries of the response
+func (cl *Client) History(filename string) (*fs.Msg, error) {
+    cmd := "history " + filename + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// Session line preceding the next write, cas or delete, all the retries carry the same line
+func (cl *Client) nextSession() string {
+    cl.seq++
+    return fmt.Sprintf("session %d %d\r\n", cl.sessionId, cl.seq)
+}
+
 // Write to file
 func (cl *Client) Write(filename string, contents string, exptime int) (*fs.Msg, error) {
-    var cmd string
+    cmd := cl.nextSession()
     if exptime == 0 {
-        cmd = fmt.Sprintf("write %s %d\r\n", filename, len(contents))
+        cmd += fmt.Sprintf("write %s %d\r\n", filename, len(contents))
     } else {
-        cmd = fmt.Sprintf("write %s %d %d\r\n", filename, len(contents), exptime)
+        cmd += fmt.Sprintf("write %s %d %d\r\n", filename, len(contents), exptime)
     }
     cmd += contents + "\r\n"
     return cl.sendRcv(cmd)
 }
 
+// Append contents to the file, creating it if it does not exist
+func (cl *Client) Append(filename string, contents string) (*fs.Msg, error) {
+    cmd := cl.nextSession() + fmt.Sprintf("append %s %d\r\n", filename, len(contents))
+    cmd += contents + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// Write contents over the file from the offset, which is at most its size
+func (cl *Client) PWrite(filename string, offset int, contents string) (*fs.Msg, error) {
+    cmd := cl.nextSession() + fmt.Sprintf("pwrite %s %d %d\r\n", filename, offset, len(contents))
+    cmd += contents + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
 // CAS operation on file
 func (cl *Client) Cas(filename string, version int, contents string, exptime int) (*fs.Msg, error) {
-    var cmd string
+    cmd := cl.nextSession()
     if exptime == 0 {
-        cmd = fmt.Sprintf("cas %s %d %d\r\n", filename, version, len(contents))
+        cmd += fmt.Sprintf("cas %s %d %d\r\n", filename, version, len(contents))
     } else {
-        cmd = fmt.Sprintf("cas %s %d %d %d\r\n", filename, version, len(contents), exptime)
+        cmd += fmt.Sprintf("cas %s %d %d %d\r\n", filename, version, len(contents), exptime)
     }
     cmd += contents + "\r\n"
     return cl.sendRcv(cmd)
 }
 
+// Write to file, creating it as an ephemeral file of the session if it does not exist.
+// The file is deleted when the lease of the session, kept alive by KeepAlive, ends
+func (cl *Client) WriteEphemeral(filename string, contents string) (*fs.Msg, error) {
+    cmd := cl.nextSession() + fmt.Sprintf("write %s %d %s\r\n", filename, len(contents), fs.EPHEMERAL)
+    cmd += contents + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// CAS operation on file, creating it as an ephemeral file of the session if it does not exist.
+// Version 0 creates the file only if it does not exist, e.g. to be elected leader
+func (cl *Client) CasEphemeral(filename string, version int, contents string) (*fs.Msg, error) {
+    cmd := cl.nextSession() + fmt.Sprintf("cas %s %d %d %s\r\n", filename, version, len(contents), fs.EPHEMERAL)
+    cmd += contents + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// Start or renew the lease of the session for ttl seconds, 0 ends the session right away.
+// Keepalives are to be sent well within the ttl, e.g. every third of it
+func (cl *Client) KeepAlive(ttl int) (*fs.Msg, error) {
+    cmd := cl.nextSession() + fmt.Sprintf("keepalive %d\r\n", ttl)
+    return cl.sendRcv(cmd)
+}
+
+// Create file, only if it does not exist. Sequential file is named by the prefix followed by a
+// counter, e.g. "/queue/" creates "/queue/0000000007". Filename of the response is the name created
+func (cl *Client) Create(prefix string, contents string, sequential bool, ephemeral bool) (*fs.Msg, error) {
+    cmd := fmt.Sprintf("create %s %d", prefix, len(contents))
+    if sequential {
+        cmd += " " + fs.SEQUENTIAL
+    }
+    if ephemeral {
+        cmd += " " + fs.EPHEMERAL
+    }
+    cmd = cl.nextSession() + cmd + "\r\n" + contents + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// Apply the success ops if all the compares hold, the failure ops otherwise, atomically.
+// Ops are writes ('w' msgs, with Filename, Contents and Exptime) and deletes ('d' msgs)
+func (cl *Client) Txn(compares []fs.Compare, success []fs.Msg, failure []fs.Msg) (*fs.Msg, error) {
+    cmd := fmt.Sprintf("txn %d %d %d\r\n", len(compares), len(success), len(failure))
+    for _, c := range compares {
+        cmd += c.String() + "\r\n"
+    }
+    for _, op := range append(append([]fs.Msg{}, success...), failure...) {
+        switch op.Kind {
+        case 'w':
+            cmd += fmt.Sprintf("write %s %d %d\r\n", op.Filename, len(op.Contents), op.Exptime)
+            cmd += string(op.Contents) + "\r\n"
+        case 'd':
+            cmd += "delete " + op.Filename + "\r\n"
+        default:
+            return nil, fmt.Errorf("Op %c not allowed in txn", op.Kind)
+        }
+    }
+    return cl.sendRcv(cl.nextSession() + cmd)
+}
+
 // Delete file
 func (cl *Client) Delete(filename string) (*fs.Msg, error) {
-    cmd := "delete " + filename + "\r\n"
+    cmd := cl.nextSession() + "delete " + filename + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// Delete file only if it is at the version, otherwise the response is ERR_VERSION with its version
+func (cl *Client) DeleteVersion(filename string, version int) (*fs.Msg, error) {
+    cmd := cl.nextSession() + fmt.Sprintf("delete %s %d\r\n", filename, version)
+    return cl.sendRcv(cmd)
+}
+
+/***
+ *  Directory operations
+ *
+ */
+// Create directory, its parent must exist
+func (cl *Client) Mkdir(dirname string) (*fs.Msg, error) {
+    cmd := cl.nextSession() + "mkdir " + dirname + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// Remove empty directory
+func (cl *Client) Rmdir(dirname string) (*fs.Msg, error) {
+    cmd := cl.nextSession() + "rmdir " + dirname + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// List directory, contents of the response are the names separated by "\n"
+func (cl *Client) Ls(dirname string) (*fs.Msg, error) {
+    cmd := "ls " + dirname + "\r\n"
+    return cl.sendRcv(cmd)
+}
+
+// Scan files whose names start with prefix, in sorted order. Entries of the response follow
+// startAfter, which is "" for the first page and the cursor of the previous response after it
+func (cl *Client) Scan(prefix string, limit int, startAfter string) (*fs.Msg, error) {
+    cmd := fmt.Sprintf("scan %s %d", prefix, limit)
+    if startAfter != "" {
+        cmd += " " + startAfter
+    }
+    return cl.sendRcv(cmd + "\r\n")
+}
+
+/***
+ *  Watch operations
+ *
+ */
+// Watch the files whose names start with prefix, for changes after fromVersion, -1 for the changes
+// from now on. Connection is taken over by the watch, its events are read by NextEvent. After an
+// error, the watch resumes on a new connection by calling Watch with the version of the last event
+func (cl *Client) Watch(prefix string, fromVersion int) (*fs.Msg, error) {
+    cl.lock.Lock()
+    closed := cl.conn == nil
+    cl.lock.Unlock()
+    if closed && !cl.setupConnectionToServer() {
+        return nil, errNoConn
+    }
+
+    cmd := "watch " + prefix
+    if fromVersion >= 0 {
+        cmd += " " + strconv.Itoa(fromVersion)
+    }
+    return cl.sendRcv(cmd + "\r\n")
+}
+
+// Wait for the next event of the watch
+func (cl *Client) NextEvent() (fs.Event, error) {
+    cl.lock.Lock()
+    defer cl.lock.Unlock()
+
+    if cl.conn == nil {
+        return fs.Event{}, errNoConn
+    }
+    line, err := cl.reader.ReadString('\n')
+    if err != nil {
+        cl.log_error(3, "Socket read error : %v", err.Error())
+        cl.conn.Close()
+        cl.conn = nil
+        return fs.Event{}, err
+    }
+    return fs.ParseEvent(line)
+}
+
+/***
+ *  Admin operations
+ *
+ */
+// Transfer the leadership to the server
+func (cl *Client) Transfer(serverId int) (*fs.Msg, error) {
+    cmd := fmt.Sprintf("admin %s %d\r\n", fs.ADMIN_TRANSFER, serverId)
+    return cl.sendRcv(cmd)
+}
+
+// Promote the learner to voting member
+func (cl *Client) Promote(serverId int) (*fs.Msg, error) {
+    cmd := fmt.Sprintf("admin %s %d\r\n", fs.ADMIN_PROMOTE, serverId)
     return cl.sendRcv(cmd)
 }
 
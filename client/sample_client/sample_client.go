@@ -4,15 +4,24 @@ import (
     "github.com/avg598/cs733/raft_config"
     "fmt"
     "os"
+    "strconv"
     "github.com/avg598/cs733/client"
+    "github.com/avg598/cs733/client_handler/filesystem/fs"
 )
 
 func usage () {
-    fmt.Println("Usage : [read|write|cas|delete]")
-    fmt.Println("      : read   <filename>")
+    fmt.Println("Usage : [read|write|cas|create|delete|mkdir|rmdir|ls|scan|watch|admin]")
+    fmt.Println("      : read   <filename> [stale|linearizable]")
     fmt.Println("      : write  <filename> <content>")
     fmt.Println("      : cas    <filename> <version> <content>")
+    fmt.Println("      : create <prefix> <content> [sequential]")
     fmt.Println("      : delete <filename>")
+    fmt.Println("      : mkdir  <dirname>")
+    fmt.Println("      : rmdir  <dirname>")
+    fmt.Println("      : ls     <dirname>")
+    fmt.Println("      : scan   <prefix> [<limit>] [<startAfter>]")
+    fmt.Println("      : watch  <prefix> [<fromVersion>]")
+    fmt.Println("      : admin  [transfer|promote] <server id>")
 }
 func main() {
     config, err := raft_config.FromConfigFile("config.json")
@@ -41,12 +50,92 @@ func main() {
     switch os.Args[1] {
     case "read" :
         expectArgs(3)
-        msg, err := cl.Read(os.Args[2])
+        var msg *fs.Msg
+        if len(os.Args) > 3 {
+            msg, err = cl.ReadMode(os.Args[2], os.Args[3])
+        } else {
+            msg, err = cl.Read(os.Args[2])
+        }
         fmt.Printf("Msg : %+v\nErr : %v\n", msg, err)
     case "write" :
         expectArgs(4)
         msg, err := cl.Write(os.Args[2], os.Args[3], 0)
         fmt.Printf("Msg : %+v\nErr : %v\n", msg, err)
+    case "create" :
+        expectArgs(4)
+        msg, err := cl.Create(os.Args[2], os.Args[3], len(os.Args) > 4 && os.Args[4] == fs.SEQUENTIAL, false)
+        fmt.Printf("Msg : %+v\nErr : %v\n", msg, err)
+    case "mkdir", "rmdir", "ls" :
+        expectArgs(3)
+        var msg *fs.Msg
+        switch os.Args[1] {
+        case "mkdir":
+            msg, err = cl.Mkdir(os.Args[2])
+        case "rmdir":
+            msg, err = cl.Rmdir(os.Args[2])
+        case "ls":
+            msg, err = cl.Ls(os.Args[2])
+        }
+        fmt.Printf("Msg : %+v\nErr : %v\n", msg, err)
+    case "scan" :
+        expectArgs(3)
+        limit, startAfter := 0, ""
+        if len(os.Args) > 3 {
+            if limit, err = strconv.Atoi(os.Args[3]); err != nil {
+                usage()
+                os.Exit(1)
+            }
+        }
+        if len(os.Args) > 4 {
+            startAfter = os.Args[4]
+        }
+        msg, err := cl.Scan(os.Args[2], limit, startAfter)
+        fmt.Printf("Msg : %+v\nErr : %v\n", msg, err)
+    case "watch" :
+        expectArgs(3)
+        version := -1
+        if len(os.Args) > 3 {
+            if version, err = strconv.Atoi(os.Args[3]); err != nil {
+                usage()
+                os.Exit(1)
+            }
+        }
+        for {                               // Print events, resuming the watch after errors
+            msg, err := cl.Watch(os.Args[2], version)
+            if err != nil || msg.Kind != 'O' {
+                fmt.Printf("Msg : %+v\nErr : %v\n", msg, err)
+                os.Exit(1)
+            }
+            if version < 0 {
+                version = msg.Version
+            }
+            for {
+                event, err := cl.NextEvent()
+                if err != nil {
+                    break
+                }
+                fmt.Println(event)
+                version = event.Version
+            }
+        }
+    case "admin" :
+        expectArgs(4)
+        id, err := strconv.Atoi(os.Args[3])
+        if err != nil {
+            usage()
+            os.Exit(1)
+        }
+        var msg *fs.Msg
+        switch os.Args[2] {
+        case fs.ADMIN_TRANSFER:
+            msg, err = cl.Transfer(id)
+        case fs.ADMIN_PROMOTE:
+            msg, err = cl.Promote(id)
+        default:
+            usage()
+            os.Exit(1)
+        }
+        fmt.Printf("Msg : %+v\nErr : %v\n", msg, err)
     default:
         fmt.Println("Invalid operation")
         usage()
@@ -2,6 +2,7 @@ package client_handler
 
 import (
     "bufio"
+    "errors"
     "fmt"
     "net"
     "os"
@@ -17,6 +18,10 @@ import (
 )
 
 const CONNECTION_TIMEOUT = 30*time.Second // in seconds
+const EXPIRY_INTERVAL    = 250*time.Millisecond // Interval at which leader checks for expired files
+const EXPIRY_RETRY       = 5*time.Second  // Delete of expired file is proposed again, if not applied by then
+const SESSION_TIMEOUT    = time.Hour      // Session without requests for this long is forgotten
+const SESSION_EVICT_INTERVAL = 1000       // Sessions are checked for timeout once in these many logs
 
 /*
  *  Debug tools
@@ -37,13 +42,27 @@ func (chdlr *ClientHandler) log_warning(skip int, format string, args ...interfa
 var crlf = []byte{'\r', '\n'}
 
 /*
- *  Request, containing msg from client, is replicated into raft nodes
+ *  Request, containing data from client, is replicated into raft nodes
  */
 type Request struct {
-    ServerId int    // Id of raft node on which the request has arrived
-    ReqId    int    // Request id and wait channel, mapped into ActiveReq, used to send
-                    // replicated msg to correct tcp serve thread which is handling this request
-    Message  fs.Msg // Request from client
+    ServerId int            // Id of raft node on which the request has arrived, 0 if no client waits for it
+    ReqId    int            // Request id and wait channel, mapped into ActiveReq, used to send
+                            // replicated msg to correct tcp serve thread which is handling this request
+    ClientId int64          // Session of the client, 0 if the request is not part of one
+    Seq      int64          // Sequence number of the request in the session, same for the retries
+    Time     time.Time      // Time of the request, only the ones appended by the leader are committed,
+                            // so every replica applies it at the time of the leader
+    Data     interface{}    // Request from client, applied to the service, e.g. fs.Msg
+}
+
+/*
+ *  Version of the file whose delete is proposed on its expiry, or the session whose end is
+ *  proposed on the expiry of its lease
+ */
+type expiry struct {
+    Filename string
+    Version  int
+    ClientId int64
 }
 
 /*
@@ -51,22 +70,45 @@ type Request struct {
  */
 type ClientHandler struct {
     Raft             *raft_node.RaftNode
-    ActiveReq        map[int]chan fs.Msg // Mapping of request id to channel on which serve thread
+    Service          Service             // Service replicated by raft
+    FS               *fs.FS              // File system served to the clients, nil if Service is not a file system
+    ActiveReq        map[int]chan result // Mapping of request id to channel on which serve thread
                                          // is waiting for the request to get replicated on raft nodes
     ActiveReqLock    sync.RWMutex        // Lock on active requests map
     NextReqId        int                 // Next request id available to be assigned to next request
     ClientPort       int                 // Port on which the client handler will listen for client requests
+    SnapshotInterval int64               // Number of applied logs after which a snapshot is taken, 0 disables
+    ReadMode         string              // Mode of reads which do not specify one, fs.READ_STALE or fs.READ_LINEARIZABLE
+    forwardWrites    int32               // 1 to forward writes to the leader instead of redirecting the client, if not
+                                         // the leader. Accessed atomically, see SetForwardWrites
+    lastApplied      int64               // Index of last log applied to the file system
+    appliedLock      sync.Mutex          // Lock on lastApplied for the serve threads waiting on appliedCond
+    appliedCond      *sync.Cond          // Signaled when lastApplied advances
+    lastSnapshot     int64               // Index of last log captured in the snapshot
+    sessions         map[int64]session   // Last request applied for each client, replicated along with the service
+    promoteWait      map[int]chan error  // Serve threads waiting for promotion of the learner to be committed
+    promoteLock      sync.Mutex          // Lock on promoteWait
+    proposedExpiry   map[expiry]time.Time // Deletes of expired files proposed by the leader, with time of proposal
     WaitOnServerExit sync.WaitGroup
     shutDownChan     chan int            // This channel is closed in shutdown to force all threads to stop
 }
 
 /***
- *  Create client handler
+ *  Create client handler serving a file system
  *  # Id        : Id of the raft node
  *  # config    : Raft node config
  *  # restore   : Whether to clean start or resume from last crash point
  */
 func New(Id int, config *raft_config.Config, restore bool) (chd *ClientHandler) {
+    return NewService(Id, config, restore, fs.New())
+}
+
+/***
+ *  Create client handler replicating the given service. Client listener is started only
+ *  for a file system, other services are driven through Submit and Sync
+ *  # service   : Service replicated by raft, in its initial state
+ */
+func NewService(Id int, config *raft_config.Config, restore bool, service Service) (chd *ClientHandler) {
 
     // Register the structures to gob
     gob.Register(fs.Msg{})
@@ -75,9 +117,19 @@ func New(Id int, config *raft_config.Config, restore bool) (chd *ClientHandler)
     gob.Register(rsm.AppendRequestRespEvent{})
     gob.Register(rsm.RequestVoteEvent{})
     gob.Register(rsm.RequestVoteRespEvent{})
+    gob.Register(rsm.PreVoteEvent{})
+    gob.Register(rsm.PreVoteRespEvent{})
+    gob.Register(rsm.TimeoutNowEvent{})
+    gob.Register(rsm.InstallSnapshotEvent{})
+    gob.Register(rsm.InstallSnapshotRespEvent{})
     //gob.Register(rsm.TimeoutEvent{})          // Not sending timeout event, no need to register
     gob.Register(rsm.AppendEvent{})
     gob.Register(rsm.LogEntry{})
+    gob.Register(rsm.ConfigEntry{})
+    gob.Register(rsm.NoOp{})
+    gob.Register(raft_node.Message{})
+    gob.Register(ForwardRequest{})
+    gob.Register(ForwardResponse{})
 
     // Create/restore raft node based on command line parameter
     var raft *raft_node.RaftNode
@@ -89,13 +141,36 @@ func New(Id int, config *raft_config.Config, restore bool) (chd *ClientHandler)
 
     // Create client handler
     chd = &ClientHandler{
-        Raft        : raft,
-        ActiveReq   : make(map[int]chan fs.Msg),
-        NextReqId   : 0,
-        ClientPort  : config.ClientPorts[Id],
-        shutDownChan: make(chan int) }
+        Raft            : raft,
+        Service         : service,
+        sessions        : make(map[int64]session),
+        ActiveReq       : make(map[int]chan result),
+        NextReqId       : 0,
+        ClientPort      : config.ClientPorts[Id],
+        SnapshotInterval: config.SnapshotInterval,
+        ReadMode        : config.ReadMode,
+        promoteWait     : make(map[int]chan error),
+        proposedExpiry  : make(map[expiry]time.Time),
+        shutDownChan    : make(chan int) }
+    chd.appliedCond = sync.NewCond(&chd.appliedLock)
+    chd.FS, _ = service.(*fs.FS)
+    chd.SetForwardWrites(config.ForwardWrites)
+
+    // Resume service from the snapshot, remaining logs are replayed by raft node
+    if snapshot := raft.GetSnapshot(); snapshot != nil {
+        if err := chd.restore(snapshot.Data); err != nil {
+            chd.log_error(3, "Unable to restore service from snapshot : %v", err.Error())
+            os.Exit(2)
+        }
+        chd.lastApplied  = snapshot.LastIncludedIndex
+        chd.lastSnapshot = snapshot.LastIncludedIndex
+    }
 
-    chd.WaitOnServerExit.Add(2) // Client handler and listener
+    if chd.FS != nil {
+        chd.WaitOnServerExit.Add(4) // Client handler, message handler, listener and expiry thread
+    } else {
+        chd.WaitOnServerExit.Add(2) // Client handler and message handler
+    }
 
     return chd
 }
@@ -143,6 +218,42 @@ func (chd *ClientHandler) Start() {
         chd.WaitOnServerExit.Done()
     }()
 
+    chd.log_info(3, "Starting message handler")
+    go func () {
+        MessageLoop:
+        for {
+            select {
+            case msg := <-chd.Raft.MessageChannel:
+                chd.handleMessage(msg)
+            case <-chd.shutDownChan:
+                break MessageLoop
+            }
+        }
+        chd.log_info(3, "Raft node shutdown, exiting message handler thread")
+        chd.WaitOnServerExit.Done()
+    }()
+
+    if chd.FS == nil {
+        return                      // Service is not served to the clients over tcp
+    }
+
+    chd.log_info(3, "Starting expiry thread")
+    go func () {
+        ticker := time.NewTicker(EXPIRY_INTERVAL)
+        defer ticker.Stop()
+        ExpiryLoop:
+        for {
+            select {
+            case <-ticker.C:
+                chd.proposeExpiry()
+            case <-chd.shutDownChan:
+                break ExpiryLoop
+            }
+        }
+        chd.log_info(3, "Raft node shutdown, exiting expiry thread")
+        chd.WaitOnServerExit.Done()
+    }()
+
     chd.log_info(3, "Starting client listener")
     go func () {
         ListenerLoop:
@@ -200,9 +311,14 @@ func (chd *ClientHandler) serveClient(conn *net.TCPConn) {
         }
 
         // Check for read request,
-        if msg.Kind == 'r' /*read request*/ {
+        if msg.Kind == 'r' /*read request*/ || msg.Kind == 'l' /*ls request*/ || msg.Kind == 'p' /*scan request*/ || msg.Kind == 'v' /*history request*/ || msg.Kind == 'i' /*stat request*/ {
             // Do not replicate, directly serve
-            response := fs.ProcessMsg(msg)
+            var response *fs.Msg
+            if msg.ReadMode == fs.READ_LINEARIZABLE || msg.ReadMode == "" && chd.ReadMode == fs.READ_LINEARIZABLE {
+                response = chd.linearizableRead(msg)
+            } else {
+                response = chd.FS.ProcessMsg(msg)
+            }
             if !chd.replyToClient(conn, response) {    // Reply to client with response
                 chd.log_error(3, "Reply to client was not sucessful")
                 conn.Close()
@@ -212,32 +328,65 @@ func (chd *ClientHandler) serveClient(conn *net.TCPConn) {
         }
 
 
-        //Replicate msg and after receiving at commitChannel, ProcessMsg(msg)
-        reqId, waitChan := chd.RegisterRequest()
-
-        // Send request to replicate
-        request := Request{ServerId:chd.Raft.GetId(), ReqId:reqId, Message:*msg}
-        chd.Raft.Append(request)
-
-
-        // Wait for replication to happen
-        select {
-        case response := <-waitChan:
-            chd.DeregisterRequest(reqId)                // First deregister the request
+        // Watch takes over the connection, until the client closes it
+        if msg.Kind == 'h' {
+            chd.serveWatch(conn, reader, msg)
+            conn.Close()
+            return
+        }
 
-            if !chd.replyToClient(conn, &response) {    // Reply to client with response
+        // Admin commands act on raft, they are not replicated
+        if msg.Kind == 'a' {
+            if !chd.replyToClient(conn, chd.admin(msg)) {
                 chd.log_error(3, "Reply to client was not sucessful")
                 conn.Close()
                 return
             }
-        case  <- time.After(CONNECTION_TIMEOUT) :
-            chd.DeregisterRequest(reqId)
+            continue
+        }
+
+        // Expiry time is fixed before replication, so that it does not depend on when the replica applies the msg
+        stampExpiry(msg, time.Now())
 
+        //Replicate msg and after receiving at commitChannel, ProcessMsg(msg)
+        response, err := chd.SubmitSession(msg.ClientId, msg.Seq, *msg)
+        if notLeader, ok := err.(rsm.Error_NotLeader); ok && chd.forwarding() && notLeader.LeaderId != 0 {
+            response, err = chd.forward(notLeader.LeaderId, msg.ClientId, msg.Seq, *msg)
+        }
+        if err == ErrTimeout || err == ErrShutdown {
             chd.log_error(3, "Connection timed out, closing the connection")
             chd.replyToClient(conn, &fs.Msg{Kind:'I'})  // Reply with internal error
             conn.Close()
             return
         }
+
+        var reply *fs.Msg
+        if err != nil {
+            reply = chd.errorMsg(err)
+        } else {
+            resp := response.(fs.Msg)
+            reply = &resp
+        }
+        if !chd.replyToClient(conn, reply) {            // Reply to client with response
+            chd.log_error(3, "Reply to client was not sucessful")
+            conn.Close()
+            return
+        }
+    }
+}
+
+
+/***
+ *  Set the absolute expiry time of the msg, and of the writes in it if it is a txn
+ */
+func stampExpiry(msg *fs.Msg, now time.Time) {
+    if msg.Exptime > 0 {
+        msg.Absexptime = now.Add(time.Duration(msg.Exptime) * time.Second)
+    }
+    for _, ops := range [][]fs.Msg{msg.Success, msg.Failure} {
+        for i := range ops {
+            stampExpiry(&ops[i], now)
+        }
     }
 }
 
@@ -245,37 +394,249 @@ func (chd *ClientHandler) serveClient(conn *net.TCPConn) {
 /***
  *  Handle commit action received on commit channel of raft.
  *
- *  Applies commited request to file system, generates the response,
+ *  Applies commited request to the service, generates the response,
  *  sends the response to appropriate client serve thread only if
  *  the request was made to this server.
  */
 func (chd *ClientHandler) handleCommit (commitAction rsm.CommitAction) {
-    var response *fs.Msg
+    var response interface{}
+    err := commitAction.Err
 
-    request := commitAction.Data.(Request)
+    if snapshot, ok := commitAction.Data.(rsm.Snapshot); ok {
+        chd.installSnapshot(snapshot)                   // Snapshot received from the leader
+        return
+    }
 
-    if commitAction.Err == nil {                        // Check if replication was successful
-        response = fs.ProcessMsg(&request.Message)      // Apply request to state machine, i.e. Filesystem
-    } else {
-        switch commitAction.Err.(type) {
-        case rsm.Error_Commit:                          // Unable to commit, internal error
-            response = &fs.Msg{Kind:'I'}
-        case rsm.Error_NotLeader:                       // Not a leader, redirect error
-            errorNotLeader := commitAction.Err.(rsm.Error_NotLeader)
-            response = &fs.Msg{
-                Kind            : 'R',
-                RedirectAddr    : chd.Raft.ServerList[ errorNotLeader.LeaderId ] }
-        default:
-            chd.log_error(3, "Unknown error type : %v", commitAction.Err)
+    if commitAction.Err == nil && commitAction.Index <= chd.lastApplied {
+        return                                          // Already captured in the snapshot
+    }
+
+    request, ok := commitAction.Data.(Request)
+    if !ok {                                            // Raft's own entries, like configuration changes,
+        chd.notifyPromote(commitAction)                 // are not applied to the service
+        if commitAction.Err == nil {
+            chd.setLastApplied(commitAction.Index)
+            chd.Raft.UpdateLastApplied(commitAction.Index)
+            chd.checkSnapshot()
         }
+        return
+    }
+
+    if commitAction.Err == nil {                        // Check if replication was successful
+        response, err = chd.apply(commitAction.Index, request)  // Apply request to state machine, e.g. Filesystem
+        chd.setLastApplied(commitAction.Index)
     }
 
     chd.Raft.UpdateLastApplied(commitAction.Index)      // Update last applied
+    chd.checkSnapshot()
 
     // Reply only if the client has requested this server
     if request.ServerId == chd.Raft.GetId() {
-        chd.SendToWaitCh(request.ReqId, *response)      // Send response to corresponding serve thread
+        chd.SendToWaitCh(request.ReqId, result{Response: response, Err: err})  // Send response to corresponding serve thread
+    }
+}
+
+
+/***
+ *  Leader replicates deletes of the expired files, so that every replica deletes
+ *  a file at the same point in the logs, rather than on its own timer
+ */
+func (chd *ClientHandler) proposeExpiry() {
+    if !chd.Raft.IsLeader() {
+        chd.proposedExpiry = make(map[expiry]time.Time)
+        return
+    }
+
+    now := time.Now()
+    proposed := make(map[expiry]time.Time)
+    for _, msg := range chd.FS.Expired(now) {
+        key := expiry{Filename: msg.Filename, Version: msg.Version, ClientId: msg.ClientId}
+        if at, ok := chd.proposedExpiry[key]; ok && now.Sub(at) < EXPIRY_RETRY {
+            proposed[key] = at                          // Still waiting to be applied
+            continue
+        }
+        if msg.Kind == 'K' {
+            chd.log_info(3, "Proposing end of session %v, its lease has expired", msg.ClientId)
+        } else {
+            chd.log_info(3, "Proposing delete of expired file %v, version %v", msg.Filename, msg.Version)
+        }
+        chd.Raft.Append(Request{ServerId:0, ReqId:0, Time:now, Data:*msg})
+        proposed[key] = now
     }
+    chd.proposedExpiry = proposed
+}
+
+
+/***
+ *  Replace service with the snapshot received from the leader. Raft has already discarded
+ *  the logs it covers, so the service cannot go on without it
+ */
+func (chd *ClientHandler) installSnapshot(snapshot rsm.Snapshot) {
+    if snapshot.LastIncludedIndex <= chd.lastApplied {
+        return
+    }
+
+    if err := chd.restore(snapshot.Data); err != nil {
+        chd.log_error(3, "Unable to restore service from snapshot : %v", err.Error())
+        os.Exit(2)
+    }
+    chd.log_info(3, "Service restored from snapshot at index %v", snapshot.LastIncludedIndex)
+    chd.setLastApplied(snapshot.LastIncludedIndex)
+    chd.lastSnapshot = snapshot.LastIncludedIndex
+    chd.Raft.UpdateLastApplied(snapshot.LastIncludedIndex)
+}
+
+/***
+ *  Update index of last log applied to the service and wake up the waiting reads
+ */
+func (chd *ClientHandler) setLastApplied(index int64) {
+    chd.appliedLock.Lock()
+    chd.lastApplied = index
+    chd.appliedLock.Unlock()
+    chd.appliedCond.Broadcast()
+}
+
+/***
+ *  Serve admin command, leader redirects the client if it is not the leader
+ */
+func (chd *ClientHandler) admin(msg *fs.Msg) *fs.Msg {
+    var err error
+    switch msg.Admin {
+    case fs.ADMIN_TRANSFER:
+        err = chd.Raft.TransferLeadership(msg.ServerId)
+    case fs.ADMIN_PROMOTE:
+        err = chd.promoteLearner(msg.ServerId)
+    }
+
+    if err != nil {
+        switch err.(type) {
+        case rsm.Error_NotLeader:                       // Not a leader, redirect error
+            return chd.redirect(err.(rsm.Error_NotLeader))
+        default:
+            chd.log_error(3, "Admin command %v failed : %v", msg.Admin, err.Error())
+            return &fs.Msg{Kind:'I'}
+        }
+    }
+    return &fs.Msg{Kind:'O'}
+}
+
+/***
+ *  Promote the learner and wait until the configuration in which it votes is committed
+ */
+func (chd *ClientHandler) promoteLearner(id int) error {
+    waitCh := make(chan error, 1)
+    chd.promoteLock.Lock()
+    chd.promoteWait[id] = waitCh
+    chd.promoteLock.Unlock()
+
+    defer func() {
+        chd.promoteLock.Lock()
+        delete(chd.promoteWait, id)
+        chd.promoteLock.Unlock()
+    }()
+
+    chd.Raft.PromoteLearner(id)
+    select {
+    case err := <-waitCh:
+        return err
+    case <-time.After(CONNECTION_TIMEOUT):
+        return errors.New("Promotion not committed before timeout")
+    }
+}
+
+/***
+ *  Notify serve threads waiting on promotion, on rejection of the request or commit of the configuration
+ */
+func (chd *ClientHandler) notifyPromote(commitAction rsm.CommitAction) {
+    chd.promoteLock.Lock()
+    defer chd.promoteLock.Unlock()
+
+    notify := func(waitCh chan error, err error) {
+        select {
+        case waitCh <- err:
+        default:                                        // Already notified
+        }
+    }
+
+    switch commitAction.Data.(type) {
+    case rsm.PromoteLearnerEvent:
+        if waitCh, ok := chd.promoteWait[commitAction.Data.(rsm.PromoteLearnerEvent).Id]; ok && commitAction.Err != nil {
+            notify(waitCh, commitAction.Err)
+        }
+    case rsm.ConfigEntry:
+        config := commitAction.Data.(rsm.ConfigEntry)
+        if commitAction.Err != nil || config.Old != nil {
+            return                                      // Joint configuration is not final
+        }
+        for id, waitCh := range chd.promoteWait {
+            for _, member := range config.New {
+                if member == id {
+                    notify(waitCh, nil)
+                }
+            }
+        }
+    }
+}
+
+/***
+ *  Response to the client for the request which could not be replicated
+ */
+func (chd *ClientHandler) errorMsg(err error) *fs.Msg {
+    switch err.(type) {
+    case rsm.Error_Commit:                              // Unable to commit, internal error
+        return &fs.Msg{Kind:'I'}
+    case rsm.Error_NotLeader:                           // Not a leader, redirect error
+        return chd.redirect(err.(rsm.Error_NotLeader))
+    default:
+        chd.log_error(3, "Unknown error type : %v", err)
+        return &fs.Msg{Kind:'I'}
+    }
+}
+
+/***
+ *  Redirect client to the current leader, if the leader is not known (e.g. leader stepped down
+ *  on losing contact with majority) reply with internal error, so that client retries
+ */
+func (chd *ClientHandler) redirect(err rsm.Error_NotLeader) *fs.Msg {
+    if err.LeaderId == 0 {
+        return &fs.Msg{Kind:'I'}
+    }
+    return &fs.Msg{
+        Kind            : 'R',
+        RedirectAddr    : chd.Raft.ServerList[ err.LeaderId ] }
+}
+
+/***
+ *  Serve read on the leader, after all the logs committed before the read arrived are applied
+ */
+func (chd *ClientHandler) linearizableRead(msg *fs.Msg) *fs.Msg {
+    if err := chd.Sync(); err != nil {
+        switch err.(type) {
+        case rsm.Error_NotLeader:                       // Not a leader, redirect error
+            return chd.redirect(err.(rsm.Error_NotLeader))
+        default:
+            chd.log_error(3, "Unable to serve linearizable read : %v", err.Error())
+            return &fs.Msg{Kind:'I'}
+        }
+    }
+    return chd.FS.ProcessMsg(msg)
+}
+
+/***
+ *  Take snapshot of the service, if SnapshotInterval logs are applied since last snapshot
+ */
+func (chd *ClientHandler) checkSnapshot() {
+    if chd.SnapshotInterval <= 0 || chd.lastApplied - chd.lastSnapshot < chd.SnapshotInterval {
+        return
+    }
+
+    data, err := chd.snapshot()
+    if err != nil {
+        chd.log_error(3, "Unable to take snapshot of service : %v", err.Error())
+        return
+    }
+    chd.Raft.Snapshot(chd.lastApplied, data)
+    chd.lastSnapshot = chd.lastApplied
 }
 
 
@@ -285,8 +646,8 @@ func (chd *ClientHandler) handleCommit (commitAction rsm.CommitAction) {
  */
 
 // Register client request and returns request id
-func (chd *ClientHandler) RegisterRequest() (reqId int, waitChan chan fs.Msg) {
-    waitChan = make(chan fs.Msg)
+func (chd *ClientHandler) RegisterRequest() (reqId int, waitChan chan result) {
+    waitChan = make(chan result)
     chd.ActiveReqLock.Lock()
     chd.NextReqId++
     reqId = chd.NextReqId
@@ -303,8 +664,8 @@ func (chd *ClientHandler) DeregisterRequest(reqId int) {
     chd.ActiveReqLock.Unlock()
 }
 
-// Send msg to the serve thread waiting for the request to get replicated
-func (chd *ClientHandler) SendToWaitCh (reqId int, msg fs.Msg) {
+// Send response to the serve thread waiting for the request to get replicated
+func (chd *ClientHandler) SendToWaitCh (reqId int, msg result) {
     chd.ActiveReqLock.RLock()
     conn, ok := chd.ActiveReq[reqId]    // Extract wait channel from map
     if ok {                             // If request was not de-registered due to timeout
@@ -336,8 +697,36 @@ func (chd *ClientHandler) replyToClient(conn *net.TCPConn, msg *fs.Msg) bool {
         if msg.Version > 0 {
             resp += strconv.Itoa(msg.Version)
         }
+        if msg.Filename != "" {         // name of the file created
+            resp += " " + msg.Filename
+        }
+    case 'L': // ls response
+        resp = fmt.Sprintf("LIST %d %d", msg.Version, msg.Numbytes)
+    case 'H': // history response
+        resp = fmt.Sprintf("HISTORY %d", len(msg.Entries))
+    case 'A': // stat response
+        resp = msg.Stat.String()
+    case 'Y': // txn response
+        result := "success"
+        if !msg.Succeeded {
+            result = "failure"
+        }
+        resp = fmt.Sprintf("TXN %s %d", result, len(msg.Responses))
+    case 'S': // scan response
+        resp = fmt.Sprintf("SCAN %d", len(msg.Entries))
+        if msg.Cursor != "" {
+            resp += " " + msg.Cursor
+        }
     case 'F':
         resp = "ERR_FILE_NOT_FOUND"
+    case 'N':
+        resp = "ERR_NOT_DIR"
+    case 'T':
+        resp = "ERR_IS_DIR"
+    case 'E':
+        resp = "ERR_NOT_EMPTY"
+    case 'X':
+        resp = "ERR_SESSION_EXPIRED"
     case 'V':
         resp = "ERR_VERSION " + strconv.Itoa(msg.Version)
     case 'M':
@@ -352,10 +741,19 @@ func (chd *ClientHandler) replyToClient(conn *net.TCPConn, msg *fs.Msg) bool {
     }
     resp += "\r\n"
     write([]byte(resp))
-    if msg.Kind == 'C' {
+    if msg.Kind == 'C' || msg.Kind == 'L' {
         write(msg.Contents)
         write(crlf)
     }
+    for _, entry := range msg.Entries {
+        write([]byte(entry.String()))
+        write(crlf)
+    }
+    for i := range msg.Responses {
+        if err == nil && !chd.replyToClient(conn, &msg.Responses[i]) {
+            return false
+        }
+    }
     return err == nil
 }
 
@@ -368,6 +766,9 @@ func (chd *ClientHandler) Shutdown() {
 
     chd.Raft.Shutdown()         // Shutdown raft node
     close(chd.shutDownChan)     // Shutdown commit handler and client listener threads
+    chd.appliedLock.Lock()      // Wake up reads waiting for logs to be applied
+    chd.appliedCond.Broadcast()
+    chd.appliedLock.Unlock()
     chd.WaitOnServerExit.Wait()
 
     // Disconnect all connections
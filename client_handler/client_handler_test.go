@@ -1,12 +1,15 @@
 package client_handler
 
 import (
+    "bufio"
+    "net"
     "testing"
     "time"
     "fmt"
     "bytes"
     "sync"
     "strings"
+    "strconv"
     "errors"
     "os"
     "github.com/cs733-iitb/cluster"
@@ -45,6 +48,7 @@ func TestCHDMain(t *testing.T) {
                                                 OutboxSize:100000,
                                             },
         ClientPorts      : []int{ 0, 9001, 9002, 9003, 9004, 9005},
+        SnapshotInterval : 100,
         ServerList       : []string{
             "",
             "localhost:9001",
@@ -59,6 +63,7 @@ func TestCHDMain(t *testing.T) {
         //config.Id+=i
         //config.ClientPort+=i
         config.ElectionTimeout += 90000*(i-1)
+        config.HeartbeatTimeout += 90000*(i-1)   // Node 1 times out first, pre-vote would not let it depose other leader
 
         clientHandlers = append(clientHandlers, New(i, &config,false))
 
@@ -113,6 +118,445 @@ func TestCHD_Binary(t *testing.T) {
 }
 
 
+// Connects to the server without the client package, which retries and follows redirects
+func rawClient(t *testing.T, addr string) (net.Conn, func(string) (*fs.Msg, error)) {
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal("Unable to connect : " + err.Error())
+    }
+    reader := bufio.NewReader(conn)
+    sendRcv := func(str string) (*fs.Msg, error) {
+        if _, err := conn.Write([]byte(str)); err != nil {
+            return nil, err
+        }
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        msg, msgerr, fatalerr := fs.PaserString(line)
+        if fatalerr != nil {
+            return nil, fatalerr
+        }
+        return msg, msgerr
+    }
+    return conn, sendRcv
+}
+
+func TestCHD_ExactlyOnce(t *testing.T) {
+    conn, sendRcv := rawClient(t, baseConfig.ServerList[1])
+    defer conn.Close()
+
+    // Retry of the write is answered with the response of the first one
+    m, err := sendRcv("session 733 1\r\nwrite once 3\r\nabc\r\n")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    version := m.Version
+    m, err = sendRcv("session 733 1\r\nwrite once 3\r\nabc\r\n")
+    expect(t, m, &fs.Msg{Kind: 'O', Version: version}, "same version for retried write", err)
+
+    // Retry of the cas does not fail with version error
+    m, err = sendRcv(fmt.Sprintf("session 733 2\r\ncas once %d 3\r\ndef\r\n", version))
+    expect(t, m, &fs.Msg{Kind: 'O'}, "cas success", err)
+    casVersion := m.Version
+    m, err = sendRcv(fmt.Sprintf("session 733 2\r\ncas once %d 3\r\ndef\r\n", version))
+    expect(t, m, &fs.Msg{Kind: 'O', Version: casVersion}, "same version for retried cas", err)
+
+    // Next request of the session is applied
+    m, err = sendRcv("session 733 3\r\nwrite once 3\r\nghi\r\n")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    if m.Version == casVersion {
+        t.Fatalf("Expected new version for next request, got %v", m.Version)
+    }
+}
+
+
+func TestCHD_ForwardWrites(t *testing.T) {
+    conn, sendRcv := rawClient(t, baseConfig.ServerList[2])
+    defer conn.Close()
+
+    // Follower redirects the client to the leader
+    m, err := sendRcv("write fwd 3\r\nabc\r\n")
+    expect(t, m, &fs.Msg{Kind: 'R'}, "redirect to leader", err)
+
+    // With forwarding, it relays the response of the leader
+    clientHandlers[1].SetForwardWrites(true)
+    defer clientHandlers[1].SetForwardWrites(false)
+    m, err = sendRcv("write fwd 3\r\nabc\r\n")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "forwarded write success", err)
+    version := m.Version
+    m, err = sendRcv(fmt.Sprintf("cas fwd %d 3\r\ndef\r\n", version))
+    expect(t, m, &fs.Msg{Kind: 'O'}, "forwarded cas success", err)
+    m, err = sendRcv(fmt.Sprintf("cas fwd %d 3\r\nghi\r\n", version))
+    expect(t, m, &fs.Msg{Kind: 'V'}, "forwarded cas version error", err)
+
+    // Write is applied by the leader
+    m, err = sendRcv("read fwd linearizable\r\n")
+    expect(t, m, &fs.Msg{Kind: 'R'}, "redirect for linearizable read", err)
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+    m, err = cl.ReadMode("fwd", fs.READ_LINEARIZABLE)
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte("def")}, "read forwarded write", err)
+}
+
+
+func TestCHD_Directories(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    m, err := cl.Mkdir("/dirapp")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "mkdir success", err)
+    m, err = cl.Mkdir("/dirapp/config")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "mkdir success", err)
+    m, err = cl.Write("/dirapp/config/db", "localhost", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    m, err = cl.Write("/dirapp/log", "", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+
+    m, err = cl.Ls("/dirapp")
+    expect(t, m, &fs.Msg{Kind: 'L', Contents: []byte("config/\nlog")}, "ls of /dirapp", err)
+    m, err = cl.Read("/dirapp")
+    expect(t, m, &fs.Msg{Kind: 'T'}, "read of directory", err)
+    m, err = cl.Rmdir("/dirapp/config")
+    expect(t, m, &fs.Msg{Kind: 'E'}, "rmdir of non-empty directory", err)
+    m, err = cl.Ls("/dirapp/log")
+    expect(t, m, &fs.Msg{Kind: 'N'}, "ls of file", err)
+
+    m, err = cl.Delete("/dirapp")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "recursive delete", err)
+    m, err = cl.Read("/dirapp/config/db")
+    expect(t, m, &fs.Msg{Kind: 'F'}, "file in deleted directory", err)
+}
+
+func TestCHD_Scan(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    m, err := cl.Mkdir("/scanapp")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "mkdir success", err)
+    for _, name := range []string{"/scanapp/c", "/scanapp/a", "/scanapp/b", "/scanapple"} {
+        m, err = cl.Write(name, name, 0)
+        expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    }
+
+    // Pages of the prefix follow each other, in sorted order
+    names := []string{}
+    cursor := ""
+    for {
+        m, err = cl.Scan("/scanapp/", 2, cursor)
+        expect(t, m, &fs.Msg{Kind: 'S'}, "scan success", err)
+        for _, entry := range m.Entries {
+            if entry.Size != len(entry.Filename) {
+                t.Fatalf("Unexpected size of %+v", entry)
+            }
+            names = append(names, entry.Filename)
+        }
+        if cursor = m.Cursor; cursor == "" {
+            break
+        }
+    }
+    if strings.Join(names, " ") != "/scanapp/a /scanapp/b /scanapp/c" {
+        t.Fatalf("Unexpected scan : %v", names)
+    }
+}
+
+func TestCHD_Watch(t *testing.T) {
+    watcher, cl := client.New(baseConfig, 1), client.New(baseConfig, 2)
+    if watcher==nil || cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer watcher.Close()
+    defer cl.Close()
+
+    m, err := watcher.Watch("/watchapp", -1)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "watch success", err)
+
+    nextEvent := func(typ string, filename string) fs.Event {
+        event, err := watcher.NextEvent()
+        if err != nil || event.Type != typ || event.Filename != filename {
+            t.Fatalf("Expected event %v %v, got %+v, %v", typ, filename, event, err)
+        }
+        return event
+    }
+
+    m, err = cl.Write("/watchapp", "v1", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    event := nextEvent("write", "/watchapp")
+    if event.Version != m.Version {
+        t.Fatalf("Expected event of version %v, got %+v", m.Version, event)
+    }
+    m, err = cl.Cas("/watchapp", m.Version, "v2", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "cas success", err)
+    event = nextEvent("cas", "/watchapp")
+
+    // Changes while disconnected are replayed when the watch resumes
+    watcher.Close()
+    m, err = cl.Delete("/watchapp")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "delete success", err)
+    m, err = cl.Write("/watchapp", "v3", 1)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+
+    m, err = watcher.Watch("/watchapp", event.Version)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "watch success", err)
+    nextEvent("delete", "/watchapp")
+    nextEvent("write", "/watchapp")
+    nextEvent("expire", "/watchapp")
+}
+
+func TestCHD_Ephemeral(t *testing.T) {
+    leader, follower := client.New(baseConfig, 1), client.New(baseConfig, 2)
+    if leader==nil || follower==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer leader.Close()
+    defer follower.Close()
+
+    // Leader election: first session to create the ephemeral file wins
+    m, err := leader.CasEphemeral("/elect", 0, "1")
+    expect(t, m, &fs.Msg{Kind: 'X'}, "ephemeral file without lease", err)
+    m, err = leader.KeepAlive(2)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "keepalive success", err)
+    m, err = follower.KeepAlive(2)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "keepalive success", err)
+    m, err = leader.CasEphemeral("/elect", 0, "1")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "elected", err)
+    m, err = follower.CasEphemeral("/elect", 0, "2")
+    expect(t, m, &fs.Msg{Kind: 'V'}, "not elected", err)
+
+    // Keepalives hold the file, until the leader stops sending them
+    for i := 0; i < 3; i++ {
+        time.Sleep(time.Second)
+        m, err = leader.KeepAlive(2)
+        expect(t, m, &fs.Msg{Kind: 'O'}, "keepalive success", err)
+        m, err = follower.KeepAlive(2)
+        expect(t, m, &fs.Msg{Kind: 'O'}, "keepalive success", err)
+    }
+    m, err = follower.Read("/elect")
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte("1")}, "file of live session", err)
+
+    time.Sleep(3 * time.Second)
+    m, err = follower.KeepAlive(2)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "keepalive success", err)
+    m, err = follower.CasEphemeral("/elect", 0, "2")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "elected after the leader's lease expired", err)
+
+    // Session ended by the client releases the file at once
+    m, err = follower.KeepAlive(0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "end of session", err)
+    m, err = leader.Read("/elect")
+    expect(t, m, &fs.Msg{Kind: 'F'}, "file of ended session", err)
+}
+
+func TestCHD_SequentialCreate(t *testing.T) {
+    nclients := 5
+    clients := make([]*client.Client, nclients)
+    for i := 0; i < nclients; i++ {
+        if clients[i] = client.New(baseConfig, i+1); clients[i] == nil {
+            t.Fatal("Client unable to connect.")
+        }
+        defer clients[i].Close()
+    }
+    m, err := clients[0].Mkdir("/seqqueue")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "mkdir success", err)
+
+    // Concurrent creates never pick the same name
+    var wg sync.WaitGroup
+    responses, errs := make([]*fs.Msg, nclients), make([]error, nclients)
+    for i := 0; i < nclients; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            responses[i], errs[i] = clients[i].Create("/seqqueue/job-", strconv.Itoa(i), true, false)
+        }(i)
+    }
+    wg.Wait()
+    names := make([]string, nclients)
+    for i := 0; i < nclients; i++ {
+        expect(t, responses[i], &fs.Msg{Kind: 'O'}, "create success", errs[i])
+        names[i] = responses[i].Filename
+    }
+
+    m, err = clients[0].Ls("/seqqueue")
+    expect(t, m, &fs.Msg{Kind: 'L'}, "ls success", err)
+    listed := strings.Split(string(m.Contents), "\n")
+    if len(listed) != nclients {
+        t.Fatalf("Expected %v files, got %v", nclients, listed)
+    }
+    for i, name := range names {
+        if !strings.HasPrefix(name, "/seqqueue/job-") {
+            t.Fatalf("Unexpected name %v", name)
+        }
+        m, err = clients[0].Read(name)
+        expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte(strconv.Itoa(i))}, "read of created file", err)
+    }
+
+    m, err = clients[0].Create("/seqqueue/lock", "", false, false)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "create success", err)
+    m, err = clients[1].Create("/seqqueue/lock", "", false, false)
+    expect(t, m, &fs.Msg{Kind: 'V'}, "file exists", err)
+}
+
+func TestCHD_Txn(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    m, err := cl.Write("/txnmarker", "1", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    marker := m.Version
+
+    update := func(contents string) (*fs.Msg, error) {
+        return cl.Txn([]fs.Compare{{Target: fs.COMPARE_VERSION, Filename: "/txnmarker", Version: marker}},
+            []fs.Msg{{Kind: 'w', Filename: "/txnconfig", Contents: []byte(contents)}, {Kind: 'w', Filename: "/txnmarker", Contents: []byte(contents)}},
+            []fs.Msg{{Kind: 'd', Filename: "/txnmarker"}})
+    }
+    m, err = update("2")
+    expect(t, m, &fs.Msg{Kind: 'Y'}, "txn success", err)
+    if !m.Succeeded || len(m.Responses) != 2 || m.Responses[1].Kind != 'O' {
+        t.Fatalf("Unexpected txn response : %+v", m)
+    }
+    m, err = cl.Read("/txnconfig")
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte("2")}, "file written by txn", err)
+
+    m, err = update("3")
+    expect(t, m, &fs.Msg{Kind: 'Y'}, "txn success", err)
+    if m.Succeeded || len(m.Responses) != 1 {
+        t.Fatalf("Unexpected txn response : %+v", m)
+    }
+    m, err = cl.Read("/txnmarker")
+    expect(t, m, &fs.Msg{Kind: 'F'}, "file deleted by failure ops", err)
+    m, err = cl.Read("/txnconfig")
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte("2")}, "file unchanged by failed compare", err)
+}
+
+func TestCHD_History(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    m, err := cl.Write("/histfile", "good", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    good := m.Version
+    m, err = cl.Write("/histfile", "bad", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    bad := m.Version
+
+    m, err = cl.History("/histfile")
+    expect(t, m, &fs.Msg{Kind: 'H'}, "history success", err)
+    if len(m.Entries) != 2 || m.Entries[0].Version != bad || m.Entries[1].Version != good || m.Entries[1].Size != 4 {
+        t.Fatalf("Unexpected history : %+v", m.Entries)
+    }
+
+    // Roll back the bad write
+    m, err = cl.ReadVersion("/histfile", good)
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte("good"), Version: good}, "read of past version", err)
+    m, err = cl.Cas("/histfile", bad, string(m.Contents), 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "cas success", err)
+    m, err = cl.Read("/histfile")
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte("good")}, "rolled back file", err)
+}
+
+func TestCHD_DeleteVersion(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    m, err := cl.Write("/delvfile", "1", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    version := m.Version
+    m, err = cl.Write("/delvfile", "2", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+
+    m, err = cl.DeleteVersion("/delvfile", version)
+    expect(t, m, &fs.Msg{Kind: 'V'}, "delete of rewritten file", err)
+    if m.Version <= version {
+        t.Fatalf("Expected current version in ERR_VERSION, got %v", m.Version)
+    }
+    m, err = cl.DeleteVersion("/delvfile", m.Version)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "delete success", err)
+    m, err = cl.Read("/delvfile")
+    expect(t, m, &fs.Msg{Kind: 'F'}, "deleted file", err)
+}
+
+
+func TestCHD_AppendPwrite(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    m, err := cl.Append("/applog", "line1\n")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "append creates the file", err)
+    m, err = cl.Append("/applog", "line2\n")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "append success", err)
+    m, err = cl.PWrite("/applog", 4, "E1")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "pwrite success", err)
+    version := m.Version
+
+    m, err = cl.Read("/applog")
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte("lineE1line2\n"), Version: version}, "read after pwrite", err)
+    m, err = cl.ReadRange("/applog", 6, 5)
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte("line2"), Version: version}, "range read", err)
+    m, err = cl.PWrite("/applog", 100, "x")
+    expect(t, m, &fs.Msg{Kind: 'M'}, "pwrite past the end", err)
+}
+
+
+func TestCHD_Stat(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    m, err := cl.Write("/statfile", "abc", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+    created := m.Version
+    m, err = cl.Append("/statfile", "de")
+    expect(t, m, &fs.Msg{Kind: 'O'}, "append success", err)
+    version := m.Version
+
+    // Every server reports the same metadata, once it has applied the append
+    var stat *fs.Stat
+    for i := 1; i <= 5; i++ {
+        cli := client.New(baseConfig, i)
+        if cli==nil {
+            t.Fatal("Client unable to connect.")
+        }
+        defer cli.Close()
+        for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+            m, err = cli.Stat("/statfile")
+            expect(t, m, &fs.Msg{Kind: 'A'}, "stat success", err)
+            if m.Version == version || time.Since(start) > 5*time.Second {
+                break
+            }
+        }
+        if stat == nil {
+            stat = m.Stat
+            if stat.Created != created || stat.Version != version || stat.Size != 5 || !stat.Mtime.After(stat.Ctime) {
+                t.Fatalf("Unexpected stat %+v", *stat)
+            }
+        } else if !m.Stat.Ctime.Equal(stat.Ctime) || !m.Stat.Mtime.Equal(stat.Mtime) || m.Stat.Version != stat.Version || m.Stat.Checksum != stat.Checksum {
+            t.Fatalf("Stat of server %d %+v differs from %+v", i, *m.Stat, *stat)
+        }
+    }
+}
+
+
 func TestCHD_BasicSequential(t *testing.T) {
     cl := client.New(baseConfig, 1)
     if cl==nil {
@@ -165,6 +609,46 @@ func TestCHD_BasicSequential(t *testing.T) {
     expect(t, m, &fs.Msg{Kind: 'F'}, "file not found", err)
 }
 
+func TestCHD_LinearizableRead(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    data := "Fresh data"
+    m, err := cl.Write("linread", data, 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write success", err)
+
+    // Read through the leader sees the acknowledged write
+    m, err = cl.ReadMode("linread", fs.READ_LINEARIZABLE)
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte(data)}, "linearizable read my write", err)
+
+    // Stale read is still served locally
+    m, err = cl.ReadMode("linread", fs.READ_STALE)
+    expect(t, m, &fs.Msg{Kind: 'C', Contents: []byte(data)}, "stale read my write", err)
+}
+
+
+func TestCHD_AdminTransfer(t *testing.T) {
+    cl := client.New(baseConfig, 1)
+    if cl==nil {
+        t.Fatal("Client unable to connect.")
+    }
+    defer cl.Close()
+
+    // Move the leadership to node 2, writes are served by the new leader
+    m, err := cl.Transfer(2)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "transfer to 2", err)
+
+    m, err = cl.Write("transfer", "moved", 0)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "write after transfer", err)
+
+    // Move it back, follower redirects the command to the leader
+    m, err = cl.Transfer(1)
+    expect(t, m, &fs.Msg{Kind: 'O'}, "transfer back to 1", err)
+}
+
 func TestCHD_BasicTimer(t *testing.T) {
     cl := client.New(baseConfig, 1)
     if cl==nil {
@@ -366,4 +850,111 @@ func TestCHDEnd(t *testing.T) {
         // Start client handler
         clientHandlers[i].Shutdown()
     }
-}
\ No newline at end of file
+}
+
+func TestCHD_EvictSessions(t *testing.T) {
+    now := time.Now()
+    chd := &ClientHandler{sessions: map[int64]session{
+        1: {ClientId: 1, Seq: 5, LastActive: now.Add(-SESSION_TIMEOUT - time.Second)},
+        2: {ClientId: 2, Seq: 7, LastActive: now.Add(-time.Minute)},
+    }}
+    chd.evictSessions(now)
+    if _, ok := chd.sessions[1]; ok || len(chd.sessions) != 1 {
+        t.Fatalf("Expected only the idle session to be evicted, got %+v", chd.sessions)
+    }
+}
+
+// Counter service, adds the replicated increments to its value
+type counter struct {
+    sync.Mutex
+    value int
+}
+
+func (c *counter) Apply(index int64, at time.Time, data interface{}) interface{} {
+    c.Lock()
+    defer c.Unlock()
+    c.value += data.(int)
+    return c.value
+}
+func (c *counter) Snapshot() ([]byte, error) {
+    c.Lock()
+    defer c.Unlock()
+    return []byte(fmt.Sprint(c.value)), nil
+}
+func (c *counter) Restore(data []byte) error {
+    c.Lock()
+    defer c.Unlock()
+    _, err := fmt.Sscan(string(data), &c.value)
+    return err
+}
+func (c *counter) get() int {
+    c.Lock()
+    defer c.Unlock()
+    return c.value
+}
+
+func TestCHD_Service(t *testing.T) {
+    os.RemoveAll("/tmp/raft_service/")
+    defer os.RemoveAll("/tmp/raft_service/")
+
+    config := raft_config.Config(*baseConfig)
+    config.LogDir = "/tmp/raft_service/"
+    config.NumOfNodes = 3
+    config.SnapshotInterval = 5
+    config.ClusterConfig.Peers = []cluster.PeerConfig{
+        {Id: 1, Address: "localhost:7101"},
+        {Id: 2, Address: "localhost:7102"},
+        {Id: 3, Address: "localhost:7103"},
+    }
+
+    handlers := []*ClientHandler{}
+    counters := []*counter{}
+    for i:=1 ; i<=3 ; i++ {
+        conf := config
+        conf.ElectionTimeout += 90000*(i-1)
+        conf.HeartbeatTimeout += 90000*(i-1)
+        counters = append(counters, &counter{})
+        handlers = append(handlers, NewService(i, &conf, false, counters[i-1]))
+        handlers[i-1].Start()
+    }
+    defer func() {
+        for _, chd := range handlers {
+            chd.Shutdown()
+        }
+    }()
+
+    // Wait for node 1 to become the leader
+    for i := 0 ; !handlers[0].Raft.IsLeader() ; i++ {
+        if i == 100 {
+            t.Fatal("Leader not elected")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    // Increments are applied in log order, each one once
+    for i:=1 ; i<=10 ; i++ {
+        response, err := handlers[0].Submit(1)
+        if err != nil || response.(int) != i {
+            t.Fatalf("Expected counter %v, got %v, error : %v", i, response, err)
+        }
+    }
+
+    // Followers do not accept the requests, nor serve linearizable reads
+    if _, err := handlers[1].Submit(1); err == nil {
+        t.Fatal("Follower accepted the request")
+    }
+    if err := handlers[1].Sync(); err == nil {
+        t.Fatal("Follower served linearizable read")
+    }
+    if err := handlers[0].Sync(); err != nil || counters[0].get() != 10 {
+        t.Fatalf("Expected counter 10 on the leader, got %v, error : %v", counters[0].get(), err)
+    }
+
+    // Followers apply the same increments
+    for i := 0 ; counters[1].get() != 10 || counters[2].get() != 10 ; i++ {
+        if i == 100 {
+            t.Fatalf("Followers did not apply the increments, counters : %v, %v", counters[1].get(), counters[2].get())
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+}
@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Root directory, names not starting with it are in the root directory
+const ROOT = "/"
+
+// Returns the absolute, cleaned form of the name, e.g. "a//b/" is "/a/b"
+func cleanPath(name string) string {
+	return path.Clean(ROOT + name)
+}
+
+func newDir(name string, version int) *FileInfo {
+	return &FileInfo{filename: name, version: version, created: version, isDir: true, children: make(map[string]bool)}
+}
+
+// Returns the directory in which the file is to be created, or the error response
+func (fs *FS) parentDir(name string) (*FileInfo, *Msg) {
+	parent := fs.dir[path.Dir(name)]
+	if parent == nil {
+		return nil, &Msg{Kind: 'F'} // parent not found
+	} else if !parent.isDir {
+		return nil, &Msg{Kind: 'N'} // parent is a file
+	}
+	return parent, nil
+}
+
+// Removes the file, or the directory along with its contents. Root directory is only emptied.
+// Every removed name is recorded as changed by the msg of the given kind
+func (fs *FS) remove(fi *FileInfo, kind byte) {
+	children := make([]string, 0, len(fi.children))
+	for child := range fi.children {
+		children = append(children, child)
+	}
+	sort.Strings(children) // same order of events on every replica
+	for _, child := range children {
+		fs.remove(fs.dir[path.Join(fi.filename, child)], kind)
+	}
+	if fi.filename == ROOT {
+		return
+	}
+	delete(fs.dir[path.Dir(fi.filename)].children, path.Base(fi.filename))
+	delete(fs.dir, fi.filename)
+	fs.index.remove(fi.filename)
+	if l := fs.leases[fi.owner]; l != nil {
+		delete(l.files, fi.filename)
+	}
+	fs.record(kind, fi.filename)
+}
+
+func (fs *FS) processMkdir(msg *Msg) *Msg {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fi := fs.dir[msg.Filename]; fi != nil {
+		if !fi.isDir {
+			return &Msg{Kind: 'N'} // file exists with the name
+		}
+		return ok(fi.version) // already exists
+	}
+
+	parent, errMsg := fs.parentDir(msg.Filename)
+	if errMsg != nil {
+		return errMsg
+	}
+	fs.gversion += 1
+	fs.dir[msg.Filename] = newDir(msg.Filename, fs.gversion)
+	fs.dir[msg.Filename].ctime, fs.dir[msg.Filename].mtime = msg.Time, msg.Time
+	fs.index.insert(msg.Filename)
+	parent.children[path.Base(msg.Filename)] = true
+	fs.record(msg.Kind, msg.Filename)
+	return ok(fs.gversion)
+}
+
+func (fs *FS) processRmdir(msg *Msg) *Msg {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fi := fs.dir[msg.Filename]
+	if fi == nil {
+		return &Msg{Kind: 'F'} // directory not found
+	} else if !fi.isDir {
+		return &Msg{Kind: 'N'} // not a directory
+	} else if len(fi.children) > 0 {
+		return &Msg{Kind: 'E'} // directory not empty
+	} else if fi.filename == ROOT {
+		return &Msg{Kind: 'M'} // root can not be removed
+	}
+	fs.gversion += 1
+	fs.remove(fi, msg.Kind)
+	return ok(0)
+}
+
+// Lists the directory, one name per line in sorted order, names of directories end with "/"
+func (fs *FS) processLs(msg *Msg) *Msg {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	fi := fs.dir[msg.Filename]
+	if fi == nil {
+		return &Msg{Kind: 'F'} // directory not found
+	} else if !fi.isDir {
+		return &Msg{Kind: 'N'} // not a directory
+	}
+
+	names := make([]string, 0, len(fi.children))
+	for child := range fi.children {
+		if fs.dir[path.Join(fi.filename, child)].isDir {
+			child += "/"
+		}
+		names = append(names, child)
+	}
+	sort.Strings(names)
+
+	contents := []byte(strings.Join(names, "\n"))
+	return &Msg{Kind: 'L', Filename: fi.filename, Contents: contents, Numbytes: len(contents), Version: fi.version}
+}
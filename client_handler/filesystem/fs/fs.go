@@ -1,44 +1,98 @@
 package fs
 
 import (
-	_ "fmt"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"path"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Digits of the counter appended to the names of sequential files
+const SEQUENCE_DIGITS = 10
+
 type FileInfo struct {
 	filename   string
 	contents   []byte
 	version    int
 	absexptime time.Time
-	timer      *time.Timer
+	isDir      bool
+	children   map[string]bool // Names of the files and directories in the directory
+	owner      int64           // Session of the ephemeral file, 0 for other files
+	history    []revision      // Past versions, oldest first
+	created    int             // Version at which the file was created
+	ctime      time.Time       // Times of the creation and of the last change, assigned by the leader
+	mtime      time.Time
 }
 
+// File system, the state machine replicated by raft. Each server owns its instance.
 type FS struct {
 	sync.RWMutex
-	dir map[string]*FileInfo
+	dir      map[string]*FileInfo
+	index    *skipList // Names in dir, in sorted order
+	gversion int       // global version
+	events   []Event   // Recent changes, in order
+	evicted  int       // Version of the last event dropped from events
+	watchers map[*Watcher]bool
+	leases   map[int64]*lease // Leases of the sessions, by client id
 }
 
-var fs = &FS{dir: make(map[string]*FileInfo, 1000)}
-var gversion = 0 // global version
+// Returns an empty file system, with only the root directory
+func New() *FS {
+	fs := &FS{dir: make(map[string]*FileInfo, 1000), index: newSkipList(), watchers: make(map[*Watcher]bool), leases: make(map[int64]*lease)}
+	fs.dir[ROOT] = newDir(ROOT, 0)
+	fs.index.insert(ROOT)
+	return fs
+}
 
-func (fi *FileInfo) cancelTimer() {
-	if fi.timer != nil {
-		fi.timer.Stop()
-		fi.timer = nil
+func (fs *FS) ProcessMsg(msg *Msg) *Msg {
+	m := *msg
+	// Prefixes are used as they are: for scan "/app/" does not match "/apple",
+	// and a sequential create of "/queue/" creates "/queue/0000000007"
+	if msg.Kind != 'p' && msg.Kind != 'n' {
+		m.Filename = cleanPath(msg.Filename)
 	}
-}
+	// Replicated msgs carry the time assigned by the leader, like the expiry time
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	msg = &m
 
-func ProcessMsg(msg *Msg) *Msg {
 	switch msg.Kind {
 	case 'r':
-		return processRead(msg)
+		return fs.processRead(msg)
 	case 'w':
-		return processWrite(msg)
+		return fs.processWrite(msg)
 	case 'c':
-		return processCas(msg)
-	case 'd':
-		return processDelete(msg)
+		return fs.processCas(msg)
+	case 'n':
+		return fs.processCreate(msg)
+	case 'e':
+		return fs.processAppend(msg)
+	case 'o':
+		return fs.processPwrite(msg)
+	case 't':
+		return fs.processTxn(msg)
+	case 'd', 'D':
+		return fs.processDelete(msg)
+	case 'm':
+		return fs.processMkdir(msg)
+	case 'x':
+		return fs.processRmdir(msg)
+	case 'l':
+		return fs.processLs(msg)
+	case 'v':
+		return fs.processHistory(msg)
+	case 'i':
+		return fs.processStat(msg)
+	case 'p':
+		return fs.processScan(msg)
+	case 'k':
+		return fs.processKeepalive(msg)
+	case 'K':
+		return fs.processEndSession(msg)
 	}
 
 	// Default: Internal error. Shouldn't come here since
@@ -46,22 +100,52 @@ func ProcessMsg(msg *Msg) *Msg {
 	return &Msg{Kind: 'I'}
 }
 
-func processRead(msg *Msg) *Msg {
+// Applies the replicated msg, file system is the service replicated by the client handler.
+// The response is returned by value, as it is cached in the client sessions and carried in snapshots
+func (fs *FS) Apply(index int64, at time.Time, data interface{}) interface{} {
+	msg, ok := data.(Msg)
+	if !ok {
+		return Msg{Kind: 'I'}
+	}
+	msg.Time = at
+	if response := fs.ProcessMsg(&msg); response != nil {
+		return *response
+	}
+	return nil
+}
+
+// Reads the file, or the range of it from msg.Offset, of msg.Length bytes
+func (fs *FS) processRead(msg *Msg) *Msg {
 	fs.RLock()
 	defer fs.RUnlock()
+	if msg.Offset < 0 || msg.Length < 0 {
+		return &Msg{Kind: 'M'}
+	}
 	if fi := fs.dir[msg.Filename]; fi != nil {
+		if fi.isDir {
+			return &Msg{Kind: 'T'} // is a directory
+		}
+		if msg.Version > 0 && msg.Version != fi.version { // past version
+			rev := fi.revision(msg.Version)
+			if rev == nil {
+				return &Msg{Kind: 'V', Version: fi.version} // not kept
+			}
+			contents := readRange(rev.contents, msg.Offset, msg.Length)
+			return &Msg{Kind: 'C', Filename: fi.filename, Contents: contents, Numbytes: len(contents), Version: rev.version}
+		}
 		remainingTime := 0
-		if fi.timer != nil {
-			remainingTime := int(fi.absexptime.Sub(time.Now()))
+		if !fi.absexptime.IsZero() {
+			remainingTime = int(fi.absexptime.Sub(time.Now()) / time.Second)
 			if remainingTime < 0 {
 				remainingTime = 0
 			}
 		}
+		contents := readRange(fi.contents, msg.Offset, msg.Length)
 		return &Msg{
 			Kind:     'C',
 			Filename: fi.filename,
-			Contents: fi.contents,
-			Numbytes: len(fi.contents),
+			Contents: contents,
+			Numbytes: len(contents),
 			Exptime:  remainingTime,
 			Version:  fi.version,
 		}
@@ -70,75 +154,281 @@ func processRead(msg *Msg) *Msg {
 	}
 }
 
-func internalWrite(msg *Msg) *Msg {
+func (fs *FS) internalWrite(msg *Msg) *Msg {
 	fi := fs.dir[msg.Filename]
-	if fi != nil {
-		fi.cancelTimer()
+	if fi == nil {
+		parent, errMsg := fs.parentDir(msg.Filename)
+		if errMsg != nil {
+			return errMsg
+		}
+		fi = &FileInfo{created: fs.gversion + 1, ctime: msg.Time}
+		if msg.Ephemeral { // owned by the session from creation on
+			l := fs.leases[msg.ClientId]
+			if l == nil {
+				return &Msg{Kind: 'X'} // session expired, or never kept alive
+			}
+			fi.owner = msg.ClientId
+			l.files[msg.Filename] = true
+		}
+		parent.children[path.Base(msg.Filename)] = true
+	} else if fi.isDir {
+		return &Msg{Kind: 'T'} // is a directory
 	} else {
-		fi = &FileInfo{}
+		fi.keep() // contents being replaced stay readable by version
 	}
 
-	gversion += 1
+	fs.gversion += 1
 	fi.filename = msg.Filename
 	fi.contents = msg.Contents
-	fi.version = gversion
-
-	var absexptime time.Time
-	if msg.Exptime > 0 {
-		dur := time.Duration(msg.Exptime) * time.Second
-		absexptime = time.Now().Add(dur)
-		timerFunc := func(name string, ver int) func() {
-			return func() {
-				processDelete(&Msg{Kind: 'D',
-					Filename: name,
-					Version:  ver})
-			}
-		}(msg.Filename, gversion)
+	fi.version = fs.gversion
+	fi.mtime = msg.Time
 
-		fi.timer = time.AfterFunc(dur, timerFunc)
+	// Replicated writes carry the absolute expiry time, so that it is
+	// the same on every replica, even on the ones replaying the logs
+	absexptime := msg.Absexptime
+	if absexptime.IsZero() && msg.Exptime > 0 {
+		absexptime = time.Now().Add(time.Duration(msg.Exptime) * time.Second)
 	}
 	fi.absexptime = absexptime
 	fs.dir[msg.Filename] = fi
+	fs.index.insert(msg.Filename)
+	fs.record(msg.Kind, msg.Filename)
 
-	return ok(gversion)
+	return ok(fs.gversion)
 }
 
-func processWrite(msg *Msg) *Msg {
+func (fs *FS) processWrite(msg *Msg) *Msg {
 	fs.Lock()
 	defer fs.Unlock()
-	return internalWrite(msg)
+	return fs.internalWrite(msg)
 }
 
-func processCas(msg *Msg) *Msg {
+func (fs *FS) processCas(msg *Msg) *Msg {
 	fs.Lock()
 	defer fs.Unlock()
 
 	if fi := fs.dir[msg.Filename]; fi != nil {
+		if fi.isDir {
+			return &Msg{Kind: 'T'} // is a directory
+		}
 		if msg.Version != fi.version {
 			return &Msg{Kind: 'V', Version: fi.version}
 		}
 	}
-	return internalWrite(msg)
+	return fs.internalWrite(msg)
 }
 
-func processDelete(msg *Msg) *Msg {
+// Creates the file, only if it does not exist. A sequential file is named by the prefix
+// followed by the zero-padded version it is created at, which increases with every change.
+// Response carries the name of the file created.
+func (fs *FS) processCreate(msg *Msg) *Msg {
+	fs.Lock()
+	defer fs.Unlock()
+
+	name := msg.Filename
+	if msg.Sequential {
+		name += fmt.Sprintf("%0*d", SEQUENCE_DIGITS, fs.gversion+1)
+	}
+	name = cleanPath(name)
+
+	if fi := fs.dir[name]; fi != nil {
+		if fi.isDir {
+			return &Msg{Kind: 'T'} // is a directory
+		}
+		return &Msg{Kind: 'V', Version: fi.version} // exists
+	}
+	m := *msg
+	m.Filename = name
+	response := fs.internalWrite(&m)
+	if response.Kind == 'O' {
+		response.Filename = name
+	}
+	return response
+}
+
+func (fs *FS) processDelete(msg *Msg) *Msg {
 	fs.Lock()
 	defer fs.Unlock()
 	fi := fs.dir[msg.Filename]
+	if msg.Kind == 'D' && (fi == nil || fi.version != msg.Version) {
+		// Expiry of a file which has been deleted or rewritten since it was proposed
+		return nil // nothing to do
+	}
+	if msg.Kind == 'd' && fi != nil && msg.Version > 0 && fi.version != msg.Version {
+		return &Msg{Kind: 'V', Version: fi.version} // rewritten since the version was read
+	}
 	if fi != nil {
-		if msg.Version > 0 && fi.version != msg.Version {
-			// non-zero msg.Version indicates a delete due to an expired timer
-			return nil // nothing to do
-		}
-		fi.cancelTimer()
-		delete(fs.dir, msg.Filename)
+		fs.gversion += 1        // delete is a change too, watchers see it at this version
+		fs.remove(fi, msg.Kind) // directory is deleted along with its contents
 		return ok(0)
 	} else {
 		return &Msg{Kind: 'F'} // file not found
 	}
+}
 
+// Returns the deletes ('D' msgs) of the files whose expiry time has passed by now,
+// followed by the ends ('K' msgs) of the sessions whose lease has expired.
+// Files are not deleted here, the leader replicates these deletes, so that a file
+// disappears at the same point in the logs on every replica.
+func (fs *FS) Expired(now time.Time) []*Msg {
+	fs.RLock()
+	defer fs.RUnlock()
+	expired := []*Msg{}
+	for _, fi := range fs.dir {
+		if !fi.isDir && !fi.absexptime.IsZero() && !fi.absexptime.After(now) {
+			expired = append(expired, &Msg{Kind: 'D', Filename: fi.filename, Version: fi.version})
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Filename < expired[j].Filename
+	})
+	return append(expired, fs.expiredLeases(now)...)
 }
 
 func ok(version int) *Msg {
 	return &Msg{Kind: 'O', Version: version}
 }
+
+// Serialisable image of a file, used in snapshots
+type fileImage struct {
+	Filename   string
+	Contents   []byte
+	Version    int
+	Absexptime time.Time
+	IsDir      bool
+	Owner      int64
+	History    []revisionImage
+	Created    int
+	Ctime      time.Time
+	Mtime      time.Time
+}
+
+// Serialisable image of a past version of a file, used in snapshots
+type revisionImage struct {
+	Version  int
+	Contents []byte
+}
+
+// Serialisable image of the lease of a session, used in snapshots
+type leaseImage struct {
+	ClientId   int64
+	Absexptime time.Time
+}
+
+// Serialisable image of the whole file system, used in snapshots
+type fsImage struct {
+	Files    []fileImage
+	Leases   []leaseImage
+	Gversion int
+}
+
+// Returns the serialised state of the file system
+func (fs *FS) Snapshot() ([]byte, error) {
+	fs.RLock()
+	image := fsImage{Files: make([]fileImage, 0, len(fs.dir)), Gversion: fs.gversion}
+	for _, fi := range fs.dir {
+		var history []revisionImage
+		for _, rev := range fi.history {
+			history = append(history, revisionImage{Version: rev.version, Contents: rev.contents})
+		}
+		image.Files = append(image.Files, fileImage{
+			Filename:   fi.filename,
+			Contents:   fi.contents,
+			Version:    fi.version,
+			Absexptime: fi.absexptime,
+			IsDir:      fi.isDir,
+			Owner:      fi.owner,
+			History:    history,
+			Created:    fi.created,
+			Ctime:      fi.ctime,
+			Mtime:      fi.mtime,
+		})
+	}
+	for clientId, l := range fs.leases {
+		image.Leases = append(image.Leases, leaseImage{ClientId: clientId, Absexptime: l.absexptime})
+	}
+	fs.RUnlock()
+
+	// Same state results in same snapshot on every node
+	sort.Slice(image.Files, func(i, j int) bool {
+		return image.Files[i].Filename < image.Files[j].Filename
+	})
+	sort.Slice(image.Leases, func(i, j int) bool {
+		return image.Leases[i].ClientId < image.Leases[j].ClientId
+	})
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(image); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Replaces the state of the file system with the one serialised by Snapshot.
+// The swap happens under the file system lock, so readers see either the
+// old or the new state, never a mix of both. Changes in between are not known,
+// so the watchers are closed, and watches resume only from the restored version.
+func (fs *FS) Restore(data []byte) error {
+	var image fsImage
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&image); err != nil {
+		return err
+	}
+
+	dir := make(map[string]*FileInfo, len(image.Files)+1)
+	dir[ROOT] = newDir(ROOT, 0)
+	index := newSkipList()
+	index.insert(ROOT)
+	leases := make(map[int64]*lease, len(image.Leases))
+	for _, l := range image.Leases {
+		leases[l.ClientId] = newLease(l.Absexptime)
+	}
+	for _, file := range image.Files {
+		file.Filename = cleanPath(file.Filename) // snapshots taken before directories have names without leading /
+		index.insert(file.Filename)
+		if file.IsDir {
+			dir[file.Filename] = newDir(file.Filename, file.Version)
+			dir[file.Filename].ctime, dir[file.Filename].mtime = file.Ctime, file.Mtime
+			continue
+		}
+		dir[file.Filename] = &FileInfo{
+			filename:   file.Filename,
+			contents:   file.Contents,
+			version:    file.Version,
+			absexptime: file.Absexptime,
+			owner:      file.Owner,
+			created:    file.Created,
+			ctime:      file.Ctime,
+			mtime:      file.Mtime,
+		}
+		for _, rev := range file.History {
+			dir[file.Filename].history = append(dir[file.Filename].history, revision{version: rev.Version, contents: rev.Contents})
+		}
+		if l := leases[file.Owner]; l != nil {
+			l.files[file.Filename] = true
+		}
+	}
+	for name := range dir {
+		if name == ROOT {
+			continue
+		}
+		parent := dir[path.Dir(name)]
+		if parent == nil || !parent.isDir {
+			return fmt.Errorf("Parent directory of %s is not in the snapshot", name)
+		}
+		parent.children[path.Base(name)] = true
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	fs.dir = dir
+	fs.index = index
+	fs.leases = leases
+	fs.gversion = image.Gversion
+	fs.events = nil
+	fs.evicted = image.Gversion
+	for w := range fs.watchers {
+		w.close()
+	}
+	fs.watchers = make(map[*Watcher]bool)
+	return nil
+}
@@ -10,7 +10,9 @@ package fs
 
 import (
 	"bytes"
+	"encoding/gob"
 	"fmt"
+	"hash/crc32"
 	"strings"
 	"sync"
 	"testing"
@@ -40,87 +42,728 @@ func expect(t *testing.T, response *Msg, expected *Msg, errstr string) {
 	}
 }
 
+var fs = New()
+
+// Applies the deletes of the expired files, as the leader would replicate them
+func expire() {
+	for _, msg := range fs.Expired(time.Now()) {
+		fs.ProcessMsg(msg)
+	}
+}
+
 func TestFS_BasicSequential(t *testing.T) {
 	// Read non-existent file cs733
-	m := ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m := fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'F'}, "file not found")
 
 	// Delete non-existent file cs733
-	m = ProcessMsg(&Msg{Kind: 'd', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'd', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'F'}, "file not found")
 
 	// Write file cs733
 	str := "Cloud fun"
-	m = ProcessMsg(&Msg{Kind: 'w', Filename: "cs733", Contents: []byte(str)})
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "cs733", Contents: []byte(str)})
 	expect(t, m, &Msg{Kind: 'O'}, "write success")
 
 	// Expect to read it back
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str)}, "read my write")
 
 	// CAS in new value
 	version := m.Version
 	str2 := "Cloud fun 2"
 	// Cas new value
-	m = ProcessMsg(&Msg{Kind: 'c', Filename: "cs733", Contents: []byte(str2), Version: version})
+	m = fs.ProcessMsg(&Msg{Kind: 'c', Filename: "cs733", Contents: []byte(str2), Version: version})
 	expect(t, m, &Msg{Kind: 'O'}, "cas success")
 
 	// Expect to read it back
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str2)}, "read my cas")
 
 	// Expect Cas to fail with old version
-	m = ProcessMsg(&Msg{Kind: 'c', Filename: "cs733", Contents: []byte(str), Version: version})
+	m = fs.ProcessMsg(&Msg{Kind: 'c', Filename: "cs733", Contents: []byte(str), Version: version})
 	expect(t, m, &Msg{Kind: 'V'}, "cas version mismatch")
 
 	// Expect a failed cas to not have succeeded. Read should return str2.
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str2)}, "failed cas to not have succeeded")
 
 	// delete
-	m = ProcessMsg(&Msg{Kind: 'd', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'd', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'O'}, "delete success")
 
 	// Expect to not find the file
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'F'}, "file not found")
 }
 
 func TestFS_BasicTimer(t *testing.T) {
 	// Write file cs733, with expiry time of 2 seconds
 	str := "Cloud fun"
-	m := ProcessMsg(&Msg{Kind: 'w', Filename: "cs733", Contents: []byte(str), Exptime: 2})
+	m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "cs733", Contents: []byte(str), Exptime: 2})
 	expect(t, m, &Msg{Kind: 'O'}, "write success")
 
 	// Expect to read it back immediately.
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str)}, "read my cas")
 
 	time.Sleep(3 * time.Second)
+	expire()
 	// Expect to not find the file after expiry
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'F'}, "file not found")
 
 	// Recreate the file with expiry time of 1 second
-	m = ProcessMsg(&Msg{Kind: 'w', Filename: "cs733", Contents: []byte(str), Exptime: 1})
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "cs733", Contents: []byte(str), Exptime: 1})
 	expect(t, m, &Msg{Kind: 'O'}, "file recreated")
 
 	// Overwrite the file with expiry time of 4. This should be the new time.
-	m = ProcessMsg(&Msg{Kind: 'w', Filename: "cs733", Contents: []byte(str), Exptime: 3})
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "cs733", Contents: []byte(str), Exptime: 3})
 	expect(t, m, &Msg{Kind: 'O'}, "file overwriten with exptime=4")
 
 	// The last expiry time was 3 seconds. We should expect the file to still be around 2 seconds later
 	time.Sleep(2 * time.Second)
+	expire()
 	// Expect the file to not have expired.
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str)}, "file to not expire until 4 sec")
 
 	time.Sleep(3 * time.Second)
+	expire()
 	// 5 seconds since the last write. Expect the file to have expired
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "cs733"})
 	expect(t, m, &Msg{Kind: 'F'}, "file not found after 4 sec")
 }
 
+func TestFS_ReplicatedExpiry(t *testing.T) {
+	str := "Cloud fun"
+	past := time.Now().Add(-time.Second)
+
+	// Expiry time carried by the msg is used as is
+	m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "exp1", Contents: []byte(str), Exptime: 5, Absexptime: past})
+	expect(t, m, &Msg{Kind: 'O'}, "write success")
+	version := m.Version
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "exp2", Contents: []byte(str), Exptime: 5})
+	expect(t, m, &Msg{Kind: 'O'}, "write success")
+
+	expired := fs.Expired(time.Now())
+	if len(expired) != 1 || expired[0].Filename != "/exp1" || expired[0].Version != version {
+		t.Fatalf("Expected only exp1 at version %v to expire, got %+v", version, expired)
+	}
+
+	// File is not deleted until the delete is applied
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "exp1"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str)}, "expired file to exist until deleted")
+
+	// Delete of the older version does not delete the rewritten file
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "exp1", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O'}, "rewrite success")
+	if m = fs.ProcessMsg(expired[0]); m != nil {
+		t.Fatalf("Expected no response to delete of older version, got %+v", m)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "exp1"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str)}, "rewritten file to not be deleted")
+
+	// Delete of the current version deletes the file, repeating it has no effect
+	del := &Msg{Kind: 'D', Filename: "exp2", Version: fs.ProcessMsg(&Msg{Kind: 'r', Filename: "exp2"}).Version}
+	expect(t, fs.ProcessMsg(del), &Msg{Kind: 'O'}, "delete success")
+	if m = fs.ProcessMsg(del); m != nil {
+		t.Fatalf("Expected no response to repeated delete, got %+v", m)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "exp2"})
+	expect(t, m, &Msg{Kind: 'F'}, "file not found")
+}
+
+func TestFS_Instances(t *testing.T) {
+	str := "Cloud fun"
+	fs1, fs2 := New(), New()
+
+	// File systems do not share files
+	m := fs1.ProcessMsg(&Msg{Kind: 'w', Filename: "inst", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O', Version: 1}, "write success")
+	m = fs2.ProcessMsg(&Msg{Kind: 'r', Filename: "inst"})
+	expect(t, m, &Msg{Kind: 'F'}, "file not found in other instance")
+
+	// Nor the versions
+	m = fs2.ProcessMsg(&Msg{Kind: 'w', Filename: "inst", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O', Version: 1}, "write success")
+
+	// Snapshot of one restores the state in another
+	data, err := fs1.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to take snapshot : %v", err)
+	}
+	fs1.ProcessMsg(&Msg{Kind: 'w', Filename: "inst", Contents: []byte(str)})
+	if err = fs2.Restore(data); err != nil {
+		t.Fatalf("Unable to restore snapshot : %v", err)
+	}
+	m = fs2.ProcessMsg(&Msg{Kind: 'w', Filename: "inst", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O', Version: 2}, "version to continue from the snapshot")
+}
+
+func TestFS_Directories(t *testing.T) {
+	fs := New()
+	str := "Cloud fun"
+
+	// Parent must exist, and be a directory
+	m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app/db", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'F'}, "parent not found")
+	m = fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/app"})
+	expect(t, m, &Msg{Kind: 'O'}, "mkdir success")
+	m = fs.ProcessMsg(&Msg{Kind: 'm', Filename: "app/config/"})
+	expect(t, m, &Msg{Kind: 'O'}, "mkdir success")
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app/db", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O'}, "write success")
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app/db/x", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'N'}, "parent is a file")
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app/config/db", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O'}, "write success")
+
+	// Files and directories are not interchangeable
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/app"})
+	expect(t, m, &Msg{Kind: 'T'}, "read of directory")
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'T'}, "write of directory")
+	m = fs.ProcessMsg(&Msg{Kind: 'l', Filename: "/app/db"})
+	expect(t, m, &Msg{Kind: 'N'}, "ls of file")
+	m = fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/app/db"})
+	expect(t, m, &Msg{Kind: 'N'}, "mkdir over file")
+
+	// Listing is sorted, directories end with "/"
+	m = fs.ProcessMsg(&Msg{Kind: 'l', Filename: "/app"})
+	expect(t, m, &Msg{Kind: 'L', Contents: []byte("config/\ndb")}, "ls of /app")
+	m = fs.ProcessMsg(&Msg{Kind: 'l', Filename: "/"})
+	expect(t, m, &Msg{Kind: 'L', Contents: []byte("app/")}, "ls of root")
+
+	// Only empty directory is removed by rmdir, delete removes the contents too
+	m = fs.ProcessMsg(&Msg{Kind: 'x', Filename: "/app"})
+	expect(t, m, &Msg{Kind: 'E'}, "rmdir of non-empty directory")
+	data, err := fs.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to take snapshot : %v", err)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/app"})
+	expect(t, m, &Msg{Kind: 'O'}, "recursive delete")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/app/config/db"})
+	expect(t, m, &Msg{Kind: 'F'}, "file in deleted directory")
+	m = fs.ProcessMsg(&Msg{Kind: 'l', Filename: "/"})
+	expect(t, m, &Msg{Kind: 'L', Contents: []byte("")}, "ls of empty root")
+
+	// Directories are carried by the snapshot
+	if err = fs.Restore(data); err != nil {
+		t.Fatalf("Unable to restore snapshot : %v", err)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'l', Filename: "/app/config"})
+	expect(t, m, &Msg{Kind: 'L', Contents: []byte("db")}, "ls of restored directory")
+	m = fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/app/config/db"})
+	expect(t, m, &Msg{Kind: 'O'}, "delete success")
+	m = fs.ProcessMsg(&Msg{Kind: 'x', Filename: "/app/config"})
+	expect(t, m, &Msg{Kind: 'O'}, "rmdir success")
+	m = fs.ProcessMsg(&Msg{Kind: 'l', Filename: "/app"})
+	expect(t, m, &Msg{Kind: 'L', Contents: []byte("db")}, "ls after rmdir")
+}
+
+// Names of the entries of the scan response, separated by " "
+func scanNames(m *Msg) string {
+	names := make([]string, len(m.Entries))
+	for i, entry := range m.Entries {
+		names[i] = entry.Filename
+	}
+	return strings.Join(names, " ")
+}
+
+func TestFS_Scan(t *testing.T) {
+	fs := New()
+	fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/app"})
+	fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/app/config"})
+	for _, name := range []string{"/app/log", "/app/config/db", "/apple", "/app/db", "/app/config/cache", "/zoo"} {
+		m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: name, Contents: []byte(name)})
+		expect(t, m, &Msg{Kind: 'O'}, "write success")
+	}
+
+	// Files under the prefix in sorted order, directories are left out
+	m := fs.ProcessMsg(&Msg{Kind: 'p', Filename: "/app/"})
+	expect(t, m, &Msg{Kind: 'S'}, "scan success")
+	if names := scanNames(m); names != "/app/config/cache /app/config/db /app/db /app/log" || m.Cursor != "" {
+		t.Fatalf("Unexpected scan of /app/ : %v, cursor %v", names, m.Cursor)
+	}
+	if e := m.Entries[1]; e.Version != 4 || e.Size != len("/app/config/db") {
+		t.Fatalf("Unexpected entry : %+v", e)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'p', Filename: "app"})
+	if names := scanNames(m); names != "/app/config/cache /app/config/db /app/db /app/log /apple" {
+		t.Fatalf("Unexpected scan of app : %v", names)
+	}
+
+	// Pages continue from the cursor
+	m = fs.ProcessMsg(&Msg{Kind: 'p', Filename: "/app/", Limit: 3})
+	if names := scanNames(m); names != "/app/config/cache /app/config/db /app/db" || m.Cursor != "/app/db" {
+		t.Fatalf("Unexpected first page : %v, cursor %v", names, m.Cursor)
+	}
+	fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/app/db"})
+	m = fs.ProcessMsg(&Msg{Kind: 'p', Filename: "/app/", Limit: 3, Cursor: m.Cursor})
+	if names := scanNames(m); names != "/app/log" || m.Cursor != "" {
+		t.Fatalf("Unexpected second page : %v, cursor %v", names, m.Cursor)
+	}
+
+	// Index is carried by the snapshot
+	data, err := fs.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to take snapshot : %v", err)
+	}
+	fs2 := New()
+	if err = fs2.Restore(data); err != nil {
+		t.Fatalf("Unable to restore snapshot : %v", err)
+	}
+	m = fs2.ProcessMsg(&Msg{Kind: 'p', Filename: "/"})
+	if names := scanNames(m); names != "/app/config/cache /app/config/db /app/log /apple /zoo" {
+		t.Fatalf("Unexpected scan of restored fs : %v", names)
+	}
+}
+
+// Waits for the next events of the watcher, as "type filename version" separated by ", "
+func nextEvents(t *testing.T, w *Watcher, count int) string {
+	events := []string{}
+	for len(events) < count {
+		select {
+		case <-w.Ready:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d events, got %v", count, events)
+		}
+		batch, _ := w.Next()
+		for _, e := range batch {
+			events = append(events, fmt.Sprintf("%s %s %d", e.Type, e.Filename, e.Version))
+		}
+	}
+	return strings.Join(events, ", ")
+}
+
+func TestFS_Watch(t *testing.T) {
+	fs := New()
+	str := "Cloud fun"
+	fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/app"})                           // version 1
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app/db", Contents: []byte(str)}) // version 2
+
+	// Changes under the prefix from now on
+	w, m := fs.Watch("/app/", -1)
+	expect(t, m, &Msg{Kind: 'O', Version: 2}, "watch success")
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/apple", Contents: []byte(str)}) // version 3
+	fs.ProcessMsg(&Msg{Kind: 'c', Filename: "/app/db", Version: 2, Contents: []byte(str)})
+	fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/app/config"})
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app/config/db", Contents: []byte(str)})
+	fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/app/config"}) // version 7
+	if events := nextEvents(t, w, 5); events != "cas /app/db 4, mkdir /app/config 5, write /app/config/db 6, delete /app/config/db 7, delete /app/config 7" {
+		t.Fatalf("Unexpected events : %v", events)
+	}
+	fs.Unwatch(w)
+	if _, ok := w.Next(); ok {
+		t.Fatal("Expected watcher to be closed")
+	}
+
+	// Resume replays the events after the version, expiry of a rewritten file is ignored
+	fs.ProcessMsg(&Msg{Kind: 'D', Filename: "/app/db", Version: 2})
+	fs.ProcessMsg(&Msg{Kind: 'D', Filename: "/app/db", Version: 4}) // version 8
+	w, m = fs.Watch("app", 5)
+	expect(t, m, &Msg{Kind: 'O', Version: 8}, "watch success")
+	if events := nextEvents(t, w, 4); events != "write /app/config/db 6, delete /app/config/db 7, delete /app/config 7, expire /app/db 8" {
+		t.Fatalf("Unexpected replayed events : %v", events)
+	}
+
+	// Events before the snapshot are not kept by the restored file system, its watchers are closed
+	data, err := fs.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to take snapshot : %v", err)
+	}
+	if err = fs.Restore(data); err != nil {
+		t.Fatalf("Unable to restore snapshot : %v", err)
+	}
+	if _, ok := w.Next(); ok {
+		t.Fatal("Expected watcher to be closed on restore")
+	}
+	_, m = fs.Watch("/app/", 7)
+	expect(t, m, &Msg{Kind: 'V', Version: 8}, "events after version 7 are lost")
+	_, m = fs.Watch("/app/", 8)
+	expect(t, m, &Msg{Kind: 'O', Version: 8}, "watch from restored version")
+}
+
+func TestFS_RemoveOrder(t *testing.T) {
+	fs := New()
+	fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/rm"})
+	for _, name := range []string{"/rm/b", "/rm/c", "/rm/a"} {
+		fs.ProcessMsg(&Msg{Kind: 'w', Filename: name, Contents: []byte("x")})
+	}
+	w, _ := fs.Watch("/rm", -1)
+	fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/rm"})
+	if events := nextEvents(t, w, 4); events != "delete /rm/a 5, delete /rm/b 5, delete /rm/c 5, delete /rm 5" {
+		t.Fatalf("Expected events in sorted order, got %v", events)
+	}
+}
+
+func TestFS_RestoreLegacy(t *testing.T) {
+	restore := func(names ...string) (*FS, error) {
+		image := fsImage{Gversion: len(names)}
+		for i, name := range names {
+			image.Files = append(image.Files, fileImage{Filename: name, Contents: []byte("x"), Version: i + 1})
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(image); err != nil {
+			t.Fatal(err)
+		}
+		fs := New()
+		return fs, fs.Restore(buf.Bytes())
+	}
+
+	// Names from before directories are in the root directory
+	fs, err := restore("abc", "def")
+	if err != nil {
+		t.Fatalf("Unable to restore snapshot : %v", err)
+	}
+	m := fs.ProcessMsg(&Msg{Kind: 'r', Filename: "abc"})
+	expect(t, m, &Msg{Kind: 'C', Version: 1, Contents: []byte("x")}, "file of restored snapshot")
+	m = fs.ProcessMsg(&Msg{Kind: 'l', Filename: "/"})
+	if string(m.Contents) != "abc\ndef" {
+		t.Fatalf("Unexpected root directory %q", m.Contents)
+	}
+
+	if _, err = restore("x/y"); err == nil {
+		t.Fatal("Expected error for file without its directory")
+	}
+}
+
+func TestFS_WatchBehind(t *testing.T) {
+	fs := New()
+	w, _ := fs.Watch("/", -1)
+	for i := 0; i < EVENT_HISTORY+1; i++ {
+		fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/behind", Contents: []byte("x")})
+	}
+
+	// Events pending are returned along with the close, the client resumes from the last one
+	<-w.Ready
+	events, ok := w.Next()
+	if ok || len(events) != EVENT_HISTORY || events[len(events)-1].Version != EVENT_HISTORY {
+		t.Fatalf("Expected watcher closed with %d events, got %v events, ok %v", EVENT_HISTORY, len(events), ok)
+	}
+	_, m := fs.Watch("/", events[len(events)-1].Version)
+	expect(t, m, &Msg{Kind: 'O', Version: EVENT_HISTORY + 1}, "resume after falling behind")
+}
+
+func TestFS_Ephemeral(t *testing.T) {
+	fs := New()
+	str := "Cloud fun"
+
+	// Ephemeral file needs the lease of the session
+	m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/leader", Contents: []byte(str), Ephemeral: true, ClientId: 7})
+	expect(t, m, &Msg{Kind: 'X'}, "session expired")
+	m = fs.ProcessMsg(&Msg{Kind: 'k', Exptime: 1})
+	expect(t, m, &Msg{Kind: 'M'}, "keepalive without session")
+	m = fs.ProcessMsg(&Msg{Kind: 'k', Exptime: 1, ClientId: 7})
+	expect(t, m, &Msg{Kind: 'O'}, "keepalive success")
+	m = fs.ProcessMsg(&Msg{Kind: 'c', Filename: "/leader", Contents: []byte(str), Ephemeral: true, ClientId: 7})
+	expect(t, m, &Msg{Kind: 'O'}, "ephemeral create")
+	m = fs.ProcessMsg(&Msg{Kind: 'c', Filename: "/leader", Contents: []byte(str), Ephemeral: true, ClientId: 8})
+	expect(t, m, &Msg{Kind: 'V'}, "ephemeral file of other session")
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/members", Contents: []byte(str)})
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/member7", Contents: []byte(str), Ephemeral: true, ClientId: 7})
+
+	// Lease is carried by the snapshot
+	data, err := fs.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to take snapshot : %v", err)
+	}
+	if err = fs.Restore(data); err != nil {
+		t.Fatalf("Unable to restore snapshot : %v", err)
+	}
+
+	// Renewed lease is not ended by the expiry proposed before
+	time.Sleep(1100 * time.Millisecond)
+	expired := fs.Expired(time.Now())
+	if len(expired) != 1 || expired[0].Kind != 'K' || expired[0].ClientId != 7 {
+		t.Fatalf("Expected end of session 7, got %+v", expired)
+	}
+	fs.ProcessMsg(&Msg{Kind: 'k', Exptime: 1, ClientId: 7})
+	fs.ProcessMsg(expired[0])
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/leader"})
+	expect(t, m, &Msg{Kind: 'C'}, "ephemeral file of renewed session")
+
+	// Files of the session are deleted when its lease expires
+	time.Sleep(1100 * time.Millisecond)
+	for _, msg := range fs.Expired(time.Now()) {
+		fs.ProcessMsg(msg)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/leader"})
+	expect(t, m, &Msg{Kind: 'F'}, "ephemeral file of expired session")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/member7"})
+	expect(t, m, &Msg{Kind: 'F'}, "ephemeral file of expired session")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/members"})
+	expect(t, m, &Msg{Kind: 'C'}, "file outside the session")
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/leader", Contents: []byte(str), Ephemeral: true, ClientId: 7})
+	expect(t, m, &Msg{Kind: 'X'}, "session expired")
+
+	// Session ended by the client deletes its files at once
+	fs.ProcessMsg(&Msg{Kind: 'k', Exptime: 10, ClientId: 8})
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/leader", Contents: []byte(str), Ephemeral: true, ClientId: 8})
+	m = fs.ProcessMsg(&Msg{Kind: 'k', Exptime: 0, ClientId: 8})
+	expect(t, m, &Msg{Kind: 'O'}, "end of session")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/leader"})
+	expect(t, m, &Msg{Kind: 'F'}, "ephemeral file of ended session")
+}
+
+func TestFS_Create(t *testing.T) {
+	fs := New()
+	str := "Cloud fun"
+	fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/queue"})
+
+	// Plain create succeeds only once
+	m := fs.ProcessMsg(&Msg{Kind: 'n', Filename: "/lock", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O', Version: 2}, "create success")
+	if m.Filename != "/lock" {
+		t.Fatalf("Expected name /lock, got %v", m.Filename)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'n', Filename: "lock", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'V', Version: 2}, "file exists")
+	m = fs.ProcessMsg(&Msg{Kind: 'n', Filename: "/queue", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'T'}, "directory exists")
+
+	// Sequential names increase, in the order of creation
+	names := []string{}
+	for _, prefix := range []string{"/queue/", "/queue/job-", "/queue/"} {
+		m = fs.ProcessMsg(&Msg{Kind: 'n', Filename: prefix, Contents: []byte(str), Sequential: true})
+		expect(t, m, &Msg{Kind: 'O'}, "sequential create success")
+		names = append(names, m.Filename)
+	}
+	if strings.Join(names, " ") != "/queue/0000000003 /queue/job-0000000004 /queue/0000000005" {
+		t.Fatalf("Unexpected names : %v", names)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'n', Filename: "/missing/", Contents: []byte(str), Sequential: true})
+	expect(t, m, &Msg{Kind: 'F'}, "directory not found")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/queue/0000000005"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str), Version: 5}, "read of sequential file")
+}
+
+func TestFS_Txn(t *testing.T) {
+	fs := New()
+	fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/app"})
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app/config", Contents: []byte("v1")}) // version 2
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/app/marker", Contents: []byte("1")})  // version 3
+
+	update := func(compareVersion int) *Msg {
+		return fs.ProcessMsg(&Msg{Kind: 't',
+			Compares: []Compare{{COMPARE_VERSION, "/app/marker", compareVersion}, {COMPARE_MISSING, "/app/lock", 0}},
+			Success: []Msg{
+				{Kind: 'w', Filename: "/app/config", Contents: []byte("v2")},
+				{Kind: 'w', Filename: "app/marker", Contents: []byte("2")},
+			},
+			Failure: []Msg{{Kind: 'w', Filename: "/app/conflicts", Contents: []byte("1")}},
+		})
+	}
+
+	// Config and its marker are updated together
+	m := update(3)
+	if m.Kind != 'Y' || !m.Succeeded || len(m.Responses) != 2 || m.Responses[0].Version != 4 || m.Responses[1].Version != 5 {
+		t.Fatalf("Unexpected txn response : %+v", m)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/app/config"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("v2"), Version: 4}, "config written by txn")
+
+	// Stale compare runs the failure branch
+	m = update(3)
+	if m.Kind != 'Y' || m.Succeeded || len(m.Responses) != 1 {
+		t.Fatalf("Unexpected txn response : %+v", m)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/app/marker"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("2"), Version: 5}, "marker unchanged by failed txn")
+
+	// Failing op leaves everything unchanged
+	m = fs.ProcessMsg(&Msg{Kind: 't', Success: []Msg{
+		{Kind: 'w', Filename: "/app/config", Contents: []byte("v3")},
+		{Kind: 'd', Filename: "/app"},
+		{Kind: 'w', Filename: "/app/marker", Contents: []byte("3")},
+	}})
+	expect(t, m, &Msg{Kind: 'F'}, "parent deleted by earlier op")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/app/config"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("v2"), Version: 4}, "config unchanged by failed op")
+	m = fs.ProcessMsg(&Msg{Kind: 't', Success: []Msg{{Kind: 'w', Filename: "/app", Contents: []byte("x")}}})
+	expect(t, m, &Msg{Kind: 'T'}, "write of directory")
+
+	// Ops see the changes of the ops before them
+	m = fs.ProcessMsg(&Msg{Kind: 't', Success: []Msg{
+		{Kind: 'd', Filename: "/app"},
+		{Kind: 'w', Filename: "/app", Contents: []byte("file")},
+		{Kind: 'w', Filename: "/tmp", Contents: []byte("x")},
+		{Kind: 'd', Filename: "/tmp"},
+	}})
+	if m.Kind != 'Y' || !m.Succeeded || len(m.Responses) != 4 {
+		t.Fatalf("Unexpected txn response : %+v", m)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/app"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("file")}, "directory replaced by file")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/tmp"})
+	expect(t, m, &Msg{Kind: 'F'}, "file written and deleted by txn")
+
+	// Root is only emptied, files are created in it again
+	m = fs.ProcessMsg(&Msg{Kind: 't', Success: []Msg{
+		{Kind: 'd', Filename: "/"},
+		{Kind: 'w', Filename: "/fresh", Contents: []byte("x")},
+	}})
+	if m.Kind != 'Y' || !m.Succeeded || len(m.Responses) != 2 {
+		t.Fatalf("Unexpected txn response : %+v", m)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/app"})
+	expect(t, m, &Msg{Kind: 'F'}, "file deleted along with root")
+}
+
+func TestFS_History(t *testing.T) {
+	fs := New()
+	versions := []int{}
+	for i := 0; i < MAX_HISTORY+3; i++ {
+		m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/hist", Contents: []byte(fmt.Sprint(i))})
+		expect(t, m, &Msg{Kind: 'O'}, "write success")
+		versions = append(versions, m.Version)
+		fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/other", Contents: []byte("x")})
+	}
+	latest := versions[len(versions)-1]
+
+	// Past versions are read by version, latest one by default
+	m := fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/hist", Version: versions[5]})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("5"), Version: versions[5]}, "read of past version")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/hist", Version: latest})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte(fmt.Sprint(MAX_HISTORY + 2)), Version: latest}, "read of latest version")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/hist", Version: versions[1]})
+	expect(t, m, &Msg{Kind: 'V', Version: latest}, "version not kept")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/hist", Version: versions[5] + 1})
+	expect(t, m, &Msg{Kind: 'V', Version: latest}, "version of other file")
+
+	// History lists the versions kept, latest first
+	m = fs.ProcessMsg(&Msg{Kind: 'v', Filename: "hist"})
+	expect(t, m, &Msg{Kind: 'H'}, "history success")
+	if len(m.Entries) != MAX_HISTORY+1 || m.Entries[0].Version != latest || m.Entries[MAX_HISTORY].Version != versions[2] {
+		t.Fatalf("Unexpected history : %+v", m.Entries)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'v', Filename: "/"})
+	expect(t, m, &Msg{Kind: 'T'}, "history of directory")
+
+	// History is carried by the snapshot, and dropped along with the file
+	data, err := fs.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to take snapshot : %v", err)
+	}
+	fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/hist"})
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/hist", Contents: []byte("new")})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/hist", Version: versions[5]})
+	expect(t, m, &Msg{Kind: 'V'}, "history of deleted file")
+	if err = fs.Restore(data); err != nil {
+		t.Fatalf("Unable to restore snapshot : %v", err)
+	}
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/hist", Version: versions[5]})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("5"), Version: versions[5]}, "read of restored past version")
+}
+
+func TestFS_DeleteVersion(t *testing.T) {
+	fs := New()
+	str := "Cloud fun"
+	m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/delv", Contents: []byte(str)})
+	version := m.Version
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/delv", Contents: []byte(str)})
+
+	// Delete of the version read fails once the file is rewritten
+	m = fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/delv", Version: version})
+	expect(t, m, &Msg{Kind: 'V', Version: version + 1}, "version mismatch")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/delv"})
+	expect(t, m, &Msg{Kind: 'C'}, "file not deleted")
+	m = fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/delv", Version: version + 1})
+	expect(t, m, &Msg{Kind: 'O'}, "delete success")
+	m = fs.ProcessMsg(&Msg{Kind: 'd', Filename: "/delv", Version: version + 1})
+	expect(t, m, &Msg{Kind: 'F'}, "file not found")
+}
+
+func TestFS_AppendPwrite(t *testing.T) {
+	fs := New()
+	m := fs.ProcessMsg(&Msg{Kind: 'e', Filename: "/log", Contents: []byte("abc")})
+	expect(t, m, &Msg{Kind: 'O'}, "append creates the file")
+	created := m.Version
+	m = fs.ProcessMsg(&Msg{Kind: 'e', Filename: "/log", Contents: []byte("def")})
+	expect(t, m, &Msg{Kind: 'O', Version: created + 1}, "append success")
+	m = fs.ProcessMsg(&Msg{Kind: 'o', Filename: "/log", Offset: 4, Contents: []byte("XYZW")})
+	expect(t, m, &Msg{Kind: 'O', Version: created + 2}, "pwrite success")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/log"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("abcdXYZW")}, "pwrite extends the file")
+
+	// Contents replaced stay in the history
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/log", Version: created + 1})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("abcdef")}, "past version")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/log", Version: created})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("abc")}, "past version")
+
+	m = fs.ProcessMsg(&Msg{Kind: 'o', Filename: "/log", Offset: 9, Contents: []byte("x")})
+	expect(t, m, &Msg{Kind: 'M'}, "pwrite past the end")
+	m = fs.ProcessMsg(&Msg{Kind: 'o', Filename: "/log", Offset: -1, Contents: []byte("x")})
+	expect(t, m, &Msg{Kind: 'M'}, "negative offset")
+	fs.ProcessMsg(&Msg{Kind: 'm', Filename: "/logdir"})
+	m = fs.ProcessMsg(&Msg{Kind: 'e', Filename: "/logdir", Contents: []byte("x")})
+	expect(t, m, &Msg{Kind: 'T'}, "append to directory")
+
+	// Ranges
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/log", Offset: 2, Length: 3})
+	expect(t, m, &Msg{Kind: 'C', Version: created + 2, Contents: []byte("cdX")}, "range read")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/log", Offset: 5})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("YZW")}, "range up to the end")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/log", Offset: 6, Length: 10})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte("ZW")}, "range past the end")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/log", Offset: 20, Length: 1})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte{}}, "offset past the end")
+	if m.Numbytes != 0 {
+		t.Fatalf("Expected no bytes, got %d", m.Numbytes)
+	}
+
+	// Expiry time is kept
+	fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/tmplog", Contents: []byte("a"), Exptime: 100})
+	fs.ProcessMsg(&Msg{Kind: 'e', Filename: "/tmplog", Contents: []byte("b")})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "/tmplog"})
+	if m.Exptime < 98 {
+		t.Fatalf("Expected exptime kept after append, got %d", m.Exptime)
+	}
+}
+
+func TestFS_Stat(t *testing.T) {
+	fs := New()
+	created := time.Unix(1000, 0)
+	m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "/stat", Contents: []byte("abc"), Time: created})
+	version := m.Version
+	modified := created.Add(time.Minute)
+	fs.ProcessMsg(&Msg{Kind: 'e', Filename: "/stat", Contents: []byte("de"), Time: modified})
+
+	m = fs.ProcessMsg(&Msg{Kind: 'i', Filename: "/stat"})
+	expect(t, m, &Msg{Kind: 'A', Version: version + 1}, "stat success")
+	expected := Stat{Created: version, Version: version + 1, Ctime: created, Mtime: modified, Size: 5, Checksum: crc32.ChecksumIEEE([]byte("abcde"))}
+	if *m.Stat != expected {
+		t.Fatalf("Expected stat %+v, got %+v", expected, *m.Stat)
+	}
+
+	// Times are the ones replicated, not of the replica applying the msg
+	fs.Apply(0, modified.Add(time.Hour), Msg{Kind: 'm', Filename: "/statdir"})
+	m = fs.ProcessMsg(&Msg{Kind: 'i', Filename: "/statdir"})
+	if !m.Stat.Ctime.Equal(modified.Add(time.Hour)) || m.Stat.Created != m.Stat.Version || m.Stat.Size != 0 {
+		t.Fatalf("Unexpected stat of directory %+v", *m.Stat)
+	}
+
+	// Metadata is part of the snapshot
+	data, err := fs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := New()
+	if err = restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	m = restored.ProcessMsg(&Msg{Kind: 'i', Filename: "/stat"})
+	if !m.Stat.Ctime.Equal(created) || !m.Stat.Mtime.Equal(modified) || m.Stat.Created != version || m.Stat.Checksum != expected.Checksum {
+		t.Fatalf("Expected stat %+v after restore, got %+v", expected, *m.Stat)
+	}
+
+	m = fs.ProcessMsg(&Msg{Kind: 'i', Filename: "/nostat"})
+	expect(t, m, &Msg{Kind: 'F'}, "file not found")
+}
+
 func TestFS_ConcurrentWrites(t *testing.T) {
 
 	// nclients write to the same file. At the end the file should be any one clients' last write
@@ -135,7 +778,7 @@ func TestFS_ConcurrentWrites(t *testing.T) {
 			sem.Wait()
 			for j := 0; j < niters; j++ {
 				str := fmt.Sprintf("cl %d %d", i, j)
-				m := ProcessMsg(&Msg{Kind: 'w', Filename: "concWrite", Contents: []byte(str)})
+				m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "concWrite", Contents: []byte(str)})
 				ch <- m
 			}
 		}(i)
@@ -150,7 +793,7 @@ func TestFS_ConcurrentWrites(t *testing.T) {
 			t.Fatalf("Concurrent write failed with kind=%c", m.Kind)
 		}
 	}
-	m := ProcessMsg(&Msg{Kind: 'r', Filename: "concWrite"})
+	m := fs.ProcessMsg(&Msg{Kind: 'r', Filename: "concWrite"})
 	// Ensure the contents are of the form "cl <i> 9"
 	// The last write of any client ends with " 9"
 	if m.Kind != 'C' || !strings.HasSuffix(string(m.Contents), " 9") {
@@ -166,7 +809,7 @@ func TestFS_ConcurrentCas(t *testing.T) {
 	sem.Add(1)
 	nclients := 100
 	niters := 10
-	m := ProcessMsg(&Msg{Kind: 'w', Filename: "concCas"})
+	m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "concCas"})
 	ver := m.Version
 	if m.Kind != 'O' || ver == 0 {
 		t.Fatalf("Expected write to succeed and return version")
@@ -182,7 +825,7 @@ func TestFS_ConcurrentCas(t *testing.T) {
 				str := fmt.Sprintf("cl %d %d", i, j)
 				for {
 					casMsg := &Msg{Kind: 'c', Filename: "concWrite", Contents: []byte(str), Version: ver}
-					m := ProcessMsg(casMsg)
+					m := fs.ProcessMsg(casMsg)
 					if m.Kind == 'O' {
 						break
 					} else if m.Kind != 'V' {
@@ -198,8 +841,49 @@ func TestFS_ConcurrentCas(t *testing.T) {
 	time.Sleep(100 * time.Millisecond) // give goroutines a chance
 	sem.Done()                         // Start goroutines
 	wg.Wait()                          // Wait for them to finish
-	m = ProcessMsg(&Msg{Kind: 'r', Filename: "concWrite"})
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "concWrite"})
 	if m.Kind != 'C' || !strings.HasSuffix(string(m.Contents), " 9") {
 		t.Fatalf("Expected to be able to read after 1000 writes")
 	}
 }
+
+func TestFS_SnapshotRestore(t *testing.T) {
+	str := "Cloud fun"
+	m := fs.ProcessMsg(&Msg{Kind: 'w', Filename: "snap1", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O'}, "write success")
+	version := m.Version
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "snap2", Contents: []byte(str), Exptime: 1})
+	expect(t, m, &Msg{Kind: 'O'}, "write success")
+
+	data, err := fs.Snapshot()
+	if err != nil {
+		t.Fatalf("Unable to take snapshot : %v", err)
+	}
+
+	// Changes after the snapshot are lost on restore
+	m = fs.ProcessMsg(&Msg{Kind: 'd', Filename: "snap1"})
+	expect(t, m, &Msg{Kind: 'O'}, "delete success")
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "snap3", Contents: []byte(str)})
+	expect(t, m, &Msg{Kind: 'O'}, "write success")
+
+	if err = fs.Restore(data); err != nil {
+		t.Fatalf("Unable to restore snapshot : %v", err)
+	}
+
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "snap1"})
+	expect(t, m, &Msg{Kind: 'C', Contents: []byte(str), Version: version}, "file from snapshot")
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "snap3"})
+	expect(t, m, &Msg{Kind: 'F'}, "file written after snapshot to be lost")
+
+	// Expiry time is carried by the snapshot
+	time.Sleep(1500 * time.Millisecond)
+	expire()
+	m = fs.ProcessMsg(&Msg{Kind: 'r', Filename: "snap2"})
+	expect(t, m, &Msg{Kind: 'F'}, "file from snapshot to expire")
+
+	// Versions continue from the snapshot
+	m = fs.ProcessMsg(&Msg{Kind: 'w', Filename: "snap1", Contents: []byte(str)})
+	if m.Kind != 'O' || m.Version <= version {
+		t.Fatalf("Expected version greater than %v, got %v", version, m.Version)
+	}
+}
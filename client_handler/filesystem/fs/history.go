@@ -0,0 +1,48 @@
+package fs
+
+// Number of past versions kept for each file, besides the latest one
+const MAX_HISTORY = 10
+
+// Past version of a file
+type revision struct {
+	version  int
+	contents []byte
+}
+
+// Keeps the contents being replaced in the history of the file, dropping the oldest beyond MAX_HISTORY
+func (fi *FileInfo) keep() {
+	fi.history = append(fi.history, revision{version: fi.version, contents: fi.contents})
+	if len(fi.history) > MAX_HISTORY {
+		fi.history = append([]revision(nil), fi.history[len(fi.history)-MAX_HISTORY:]...)
+	}
+}
+
+// Returns the past version of the file, nil if it is not kept
+func (fi *FileInfo) revision(version int) *revision {
+	for i := range fi.history {
+		if fi.history[i].version == version {
+			return &fi.history[i]
+		}
+	}
+	return nil
+}
+
+// Lists the versions of the file kept, latest first. Versions are global, so
+// they also tell the order of the changes across files
+func (fs *FS) processHistory(msg *Msg) *Msg {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	fi := fs.dir[msg.Filename]
+	if fi == nil {
+		return &Msg{Kind: 'F'} // file not found
+	} else if fi.isDir {
+		return &Msg{Kind: 'T'} // is a directory
+	}
+
+	entries := []Entry{{Filename: fi.filename, Version: fi.version, Size: len(fi.contents)}}
+	for i := len(fi.history) - 1; i >= 0; i-- {
+		entries = append(entries, Entry{Filename: fi.filename, Version: fi.history[i].version, Size: len(fi.history[i].contents)})
+	}
+	return &Msg{Kind: 'H', Filename: fi.filename, Version: fi.version, Entries: entries}
+}
@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"sort"
+	"time"
+)
+
+// Lease of a client session, kept alive by the keepalives of the client.
+// Ephemeral files created in the session are deleted when the lease ends
+type lease struct {
+	absexptime time.Time       // assigned before replication, like the expiry time of files
+	files      map[string]bool // Names of the ephemeral files of the session
+}
+
+func newLease(absexptime time.Time) *lease {
+	return &lease{absexptime: absexptime, files: make(map[string]bool)}
+}
+
+// Starts or renews the lease of the session for msg.Exptime seconds, 0 ends the session
+func (fs *FS) processKeepalive(msg *Msg) *Msg {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if msg.ClientId == 0 {
+		return &Msg{Kind: 'M'} // lease belongs to a session
+	}
+	if msg.Exptime <= 0 {
+		fs.endSession(msg.ClientId, msg.Kind)
+		return ok(0)
+	}
+
+	absexptime := msg.Absexptime
+	if absexptime.IsZero() {
+		absexptime = time.Now().Add(time.Duration(msg.Exptime) * time.Second)
+	}
+	if l := fs.leases[msg.ClientId]; l != nil {
+		l.absexptime = absexptime
+	} else {
+		fs.leases[msg.ClientId] = newLease(absexptime)
+	}
+	return ok(0)
+}
+
+// Ends the session whose lease has expired, as proposed by the leader ('K' msg)
+func (fs *FS) processEndSession(msg *Msg) *Msg {
+	fs.Lock()
+	defer fs.Unlock()
+
+	l := fs.leases[msg.ClientId]
+	if l == nil || !l.absexptime.Equal(msg.Absexptime) {
+		// Session which has been ended or renewed since its expiry was proposed
+		return nil // nothing to do
+	}
+	fs.endSession(msg.ClientId, msg.Kind)
+	return nil
+}
+
+// Deletes the ephemeral files of the session, and its lease.
+// Called with the file system locked
+func (fs *FS) endSession(clientId int64, kind byte) {
+	l := fs.leases[clientId]
+	if l == nil {
+		return
+	}
+	if len(l.files) > 0 {
+		names := make([]string, 0, len(l.files))
+		for name := range l.files {
+			names = append(names, name)
+		}
+		sort.Strings(names) // same order of events on every replica
+
+		fs.gversion += 1
+		for _, name := range names {
+			fs.remove(fs.dir[name], kind)
+		}
+	}
+	delete(fs.leases, clientId)
+}
+
+// Returns the ends ('K' msgs) of the sessions whose lease has expired by now
+func (fs *FS) expiredLeases(now time.Time) []*Msg {
+	expired := []*Msg{}
+	for clientId, l := range fs.leases {
+		if !l.absexptime.After(now) {
+			expired = append(expired, &Msg{Kind: 'K', ClientId: clientId, Absexptime: l.absexptime})
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].ClientId < expired[j].ClientId
+	})
+	return expired
+}
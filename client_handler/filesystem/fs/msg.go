@@ -7,36 +7,135 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var MAX_FIRST_LINE_SIZE = 500
 var MAX_CONTENT_SIZE = 1 << 32
 
+// Read modes. Stale read is served from the local file system of the server,
+// linearizable read is served by the leader after confirming its leadership
+const (
+	READ_STALE        = "stale"
+	READ_LINEARIZABLE = "linearizable"
+)
+
+// Flags of the write, cas or create creating an ephemeral file, and of the create of a sequential file
+const (
+	EPHEMERAL  = "ephemeral"
+	SEQUENTIAL = "sequential"
+)
+
+// Admin commands, served by the leader of the cluster
+const (
+	ADMIN_TRANSFER = "transfer" // Transfer the leadership to the server
+	ADMIN_PROMOTE  = "promote"  // Promote the learner to voting member
+)
+
 // This struct encapsulates all messages, including requests,
 // responses and errors
 // On-the-wire message formats are:
+// Filenames are paths, e.g. /app/config/db, names without leading / are in the root directory
 // 1. Write:
-//       write <filename> <numbytes> [<exptime>]\r\n
+//       write <filename> <numbytes> [<exptime>] [ephemeral]\r\n
 //       <content bytes>\r\n
 //    Write response:
 //       OK <version>
+//    Append and partial write: (file is created if it does not exist, and keeps its exptime.
+//    Offset is at most the size of the file)
+//       append <filename> <numbytes>\r\n
+//       pwrite <filename> <offset> <numbytes>\r\n
+//       <content bytes>\r\n
+//    Append and pwrite response:
+//       OK <version>
 // 2. Read:
-//       read <filename>\r\n
-//    Read response:
+//       read <filename> [<version>] [stale|linearizable]\r\n
+//       read <filename> <offset> <length> [stale|linearizable]\r\n   (length 0 reads up to the end)
+//    Read response: (latest version, or the past version asked for, whose exptime is 0.
+//    Numbytes is the size of the range, if one is asked for)
 //       CONTENTS <version> <numbytes> <exptime> \r\n
 //       <content bytes>\r\n
+//    ERR_VERSION <version>\r\n with the latest version, if the version asked for is not kept
+//       history <filename> [stale|linearizable]\r\n
+//    History response: (versions kept, latest first)
+//       HISTORY <count>\r\n
+//       <filename> <version> <size>\r\n   (count lines)
+//       stat <filename> [stale|linearizable]\r\n
+//    Stat response: (versions of the creation and of the last change, their times in RFC 3339
+//    format, assigned by the leader, size, CRC-32 of the contents in hex, session of the ephemeral file or 0)
+//       STAT <created> <version> <ctime> <mtime> <size> <checksum> <owner>\r\n
 // 3. CAS: (Compare and Swap)
-//       cas <filename> <version> <numbytes> [<exptime>]\r\n
+//       cas <filename> <version> <numbytes> [<exptime>] [ephemeral]\r\n
 //       <content bytes>\r\n
 //    Cas response:
 //       OK <version>\r\n
-// 4. Delete:
-//       delete <filename>\r\n
+// 4. Create: (only if the file does not exist. Sequential file is named by the prefix
+//    followed by a zero-padded counter, which increases with every file created)
+//       create <prefix> <numbytes> [sequential] [ephemeral]\r\n
+//       <content bytes>\r\n
+//    Create response: (name of the file created)
+//       OK <version> <filename>\r\n
+//    ERR_VERSION <version>\r\n if the file exists
+// 5. Txn: (success ops are applied if all compares hold, failure ops otherwise. Ops are
+//    applied atomically: if any of them fails, none is, and the error of that op is returned)
+//       txn <ncompares> <nsuccess> <nfailure>\r\n
+//       <compare>\r\n                     (ncompares lines)
+//       <op>                               (nsuccess ops, then nfailure ops)
+//    Compare is one of
+//       version <filename> <version>
+//       exists <filename>
+//       missing <filename>
+//    Op is a write, without session or ephemeral flag, or a delete without version (compares
+//    check the versions), in the formats given here
+//    Txn response: (responses to the ops applied, one line each)
+//       TXN success|failure <count>\r\n
+//       OK [<version>]\r\n                (count lines)
+// 6. Delete: (deletes the directory along with its contents)
+//       delete <filename> [<version>]\r\n
 //     Delete response:
 //       OK\r\n
-// 5. Possible errors from these commands (instead of OK)
+//     ERR_VERSION <version>\r\n with the current version, if the version is given and differs
+// 7. Directories:
+//       mkdir <dirname>\r\n
+//       rmdir <dirname>\r\n    (directory must be empty)
+//     Mkdir and rmdir response:
+//       OK [<version>]\r\n
+//       ls <dirname> [stale|linearizable]\r\n
+//     Ls response: (names separated by \n, names of directories end with /)
+//       LIST <version> <numbytes>\r\n
+//       <content bytes>\r\n
+//       scan <prefix> [<limit>] [<startAfter>]\r\n
+//     Scan response: (files whose names start with prefix, in sorted order, at most limit of them.
+//     Cursor is present if more files remain, it is passed as startAfter to fetch the next page)
+//       SCAN <count> [<cursor>]\r\n
+//       <filename> <version> <size>\r\n   (count lines)
+//    A write, append, pwrite, cas, delete, mkdir or rmdir may be preceded by the session of the client:
+//       session <client id> <seq>\r\n
+//    A retry carrying the same session and seq is applied only once.
+//    The session keeps its lease alive for ttl seconds, 0 ends it. Ephemeral files,
+//    created by the session, are deleted when its lease ends:
+//       keepalive <ttl>\r\n
+//     Keepalive response:
+//       OK\r\n
+// 8. Watch: (events of the files whose names start with prefix, after fromVersion, or from now on)
+//       watch <prefix> [<fromVersion>]\r\n
+//     Watch response: (current version, followed by events until the connection is closed.
+//     Type is write, append, pwrite, cas, create, delete, expire, mkdir or rmdir)
+//       OK <version>\r\n
+//       EVENT <type> <filename> <version>\r\n
+//     ERR_VERSION <version>\r\n if the events after fromVersion are no longer kept
+// 9. Admin:
+//       admin transfer <server id>\r\n
+//       admin promote <server id>\r\n
+//     Admin response:
+//       OK\r\n
+// 10. Possible errors from these commands (instead of OK)
 //     ERR_VERSION\r\n
 //     ERR_FILE_NOT_FOUND\r\n
+//     ERR_NOT_DIR\r\n        (a directory is expected, but it is a file)
+//     ERR_IS_DIR\r\n         (a file is expected, but it is a directory)
+//     ERR_NOT_EMPTY\r\n
+//     ERR_SESSION_EXPIRED\r\n (ephemeral file of a session without lease)
 //     ERR_CMD_ERR\r\n
 //     ERR_INTERNAL\r\n
 //     ERR_REDIRECT <new leader URL>\r\n
@@ -44,22 +143,63 @@ var MAX_CONTENT_SIZE = 1 << 32
 type Msg struct {
 	// Kind = the first character of the command. For errors, it
 	// is the first letter after "ERR_", ('V' for ERR_VERSION, for
-	// example), except for "ERR_CMD_ERR", for which the kind is 'M'
+	// example), except for "ERR_CMD_ERR", for which the kind is 'M',
+	// "ERR_IS_DIR", for which it is 'T', "rmdir", for which it is 'x',
+	// "scan", for which it is 'p', "SCAN", for which it is 'S', "watch", for which it is 'h',
+	// "create", for which it is 'n', "TXN", for which it is 'Y', "history", for which it is 'v',
+	// "append", for which it is 'e', "pwrite", for which it is 'o', "stat", for which it is 'i', "STAT", for which it is 'A',
+	// and "ERR_SESSION_EXPIRED", for which it is 'X'
 	Kind            byte
 	Filename        string
 	Contents        []byte
 	Numbytes        int
 	Exptime         int     // expiry time in seconds
+	Absexptime      time.Time // absolute expiry time, assigned before replication so that replicas agree on it
+	Ephemeral       bool    // File is deleted when the lease of the session ends
+	Sequential      bool    // Name of the file created is the prefix followed by a counter
 	Version         int
+	Offset          int     // Start of the range of the pwrite or read
+	Length          int     // Length of the range of the read, 0 for up to the end
+	ReadMode        string  // READ_STALE or READ_LINEARIZABLE, empty for server's default mode
+	Admin           string  // Admin command, e.g. ADMIN_TRANSFER
+	ServerId        int     // Server on which admin command acts
+	ClientId        int64   // Session of the client, 0 if the msg is not part of one
+	Seq             int64   // Sequence number of the msg in the session
+	Limit           int     // Max number of entries in the scan response
+	Cursor          string  // Scan continues after this name. Set in the response if more entries remain
+	Entries         []Entry // Entries of the scan response
+	Compares        []Compare // Conditions of the txn
+	Success         []Msg   // Ops of the txn applied if all the compares hold
+	Failure         []Msg   // Ops of the txn applied otherwise
+	Succeeded       bool    // Compares of the txn held
+	Responses       []Msg   // Responses to the ops of the txn applied
+	Time            time.Time // Time of the change, assigned by the leader and replicated along with the msg
+	Stat            *Stat   // Metadata of the file, in the stat response
     RedirectAddr    string  // if the client is not a leader, redirect to leader url
 }
 
 func GetMsg(reader *bufio.Reader) (msg *Msg, msgerr error, fatalerr error) {
 	buf := make([]byte, MAX_FIRST_LINE_SIZE)
 	msg, msgerr, fatalerr = parseFirst(reader, buf)
+	if fatalerr == nil && msg.Kind == 's' /*session*/ {
+		clientId, seq := msg.ClientId, msg.Seq
+		msg, msgerr, fatalerr = parseFirst(reader, buf)
+		if fatalerr == nil {
+			msg.ClientId, msg.Seq = clientId, seq
+		}
+	}
 	if fatalerr == nil {
-		if msg.Kind == 'w' /*write*/|| msg.Kind == 'c' /*cas*/|| msg.Kind == 'C' /*CONTENTS*/{
+		if msg.Kind == 'w' /*write*/|| msg.Kind == 'c' /*cas*/|| msg.Kind == 'n' /*create*/|| msg.Kind == 'e' /*append*/|| msg.Kind == 'o' /*pwrite*/|| msg.Kind == 'C' /*CONTENTS*/|| msg.Kind == 'L' /*LIST*/{
 			msg.Contents, fatalerr = parseSecond(reader, msg.Numbytes)
+		} else if msg.Kind == 'S' /*SCAN*/ || msg.Kind == 'H' /*HISTORY*/ {
+			msg.Entries, fatalerr = parseEntries(reader, buf, len(msg.Entries))
+		} else if msg.Kind == 't' /*txn*/ {
+			var opErr error
+			if opErr, fatalerr = parseTxn(reader, buf, msg); opErr != nil {
+				msgerr = opErr
+			}
+		} else if msg.Kind == 'Y' /*TXN*/ {
+			msg.Responses, fatalerr = parseResponses(reader, buf, len(msg.Responses))
 		}
 	}
 	return msg, msgerr, fatalerr
@@ -111,22 +251,85 @@ func PaserString( msgstr string ) (msg *Msg, msgerr error, fatalerr error)  {
 		return i
 	}
 	version := 0
+	offset, length := 0, 0
 	numbytes := 0
 	exptime := 0
 	response := false
 	kind := byte(0)
 	redirect := ""
+	readMode := ""
+	admin := ""
+	serverId := 0
+	limit := 0
+	count := 0
+	cursor := ""
+	ephemeral := false
+	sequential := false
+	filename := ""
+	compares, nsuccess, nfailure := 0, 0, 0
+	succeeded := false
+	var stat *Stat
+	var clientId, seq int64
 
 	fields = strings.Fields(msgstr)
+	// Flags follow the other fields of write, cas and create
+	if len(fields) > 0 && (fields[0] == "write" || fields[0] == "cas" || fields[0] == "create") {
+		for n := len(fields); n > 3; n-- {
+			if fields[n-1] == EPHEMERAL {
+				ephemeral = true
+			} else if fields[n-1] == SEQUENTIAL && fields[0] == "create" {
+				sequential = true
+			} else {
+				break
+			}
+			fields = fields[:n-1]
+		}
+	}
 	switch fields[0] {
-	case "read":
+	case "read", "ls", "history", "stat": // read <filename> [<version>|<offset> <length>] [stale|linearizable], ls <dirname> [stale|linearizable]
 		checkN(fields, 2)
+		rest := fields[2:]
+		if fields[0] == "history" {
+			kind = 'v' // 'h' is taken for watch
+		} else if fields[0] == "stat" {
+			kind = 'i' // 's' is taken for session
+		} else if fields[0] == "read" && len(rest) > 0 {
+			if v, convErr := strconv.Atoi(rest[0]); convErr == nil {
+				version = v
+				rest = rest[1:]
+				if len(rest) > 0 {
+					if l, convErr := strconv.Atoi(rest[0]); convErr == nil { // range, not version
+						version, offset, length = 0, v, l
+						rest = rest[1:]
+					}
+				}
+			}
+		}
+		if fatalerr == nil && len(rest) > 0 {
+			readMode = rest[0]
+			if readMode != READ_STALE && readMode != READ_LINEARIZABLE {
+				fatalerr = fmt.Errorf("Read mode %s not recognized", readMode)
+			}
+		}
 	case "write": // write <filename> <numbytes> [<exptime>]
 		checkN(fields, 3)
 		numbytes = toInt(2, false)
 		if len(fields) >= 4 {
 			exptime = toInt(3, true)
 		}
+	case "append": // append <filename> <numbytes>
+		checkN(fields, 3)
+		numbytes = toInt(2, false)
+		kind = 'e' // 'a' is taken for admin
+	case "pwrite": // pwrite <filename> <offset> <numbytes>
+		checkN(fields, 4)
+		offset = toInt(2, true)
+		numbytes = toInt(3, false)
+		kind = 'o' // 'p' is taken for scan
+	case "create": // create <prefix> <numbytes> [sequential] [ephemeral]
+		checkN(fields, 3)
+		numbytes = toInt(2, false)
+		kind = 'n' // 'c' is taken for cas
 	case "cas": // cas <filename> <version> <numbytes> [<exptime>]
 		checkN(fields, 4)
 		version = toInt(2, true)
@@ -134,8 +337,60 @@ func PaserString( msgstr string ) (msg *Msg, msgerr error, fatalerr error)  {
 		if len(fields) == 5 {
 			exptime = toInt(4, true)
 		}
-	case "delete":
-		checkN(fields, 1)
+	case "delete": // delete <filename> [<version>]
+		checkN(fields, 2)
+		if len(fields) >= 3 {
+			version = toInt(2, true)
+		}
+	case "mkdir":
+		checkN(fields, 2)
+	case "rmdir":
+		checkN(fields, 2)
+		kind = 'x' // 'r' is taken for read
+	case "scan": // scan <prefix> [<limit>] [<startAfter>]
+		checkN(fields, 2)
+		if len(fields) >= 3 {
+			limit = toInt(2, true)
+		}
+		if len(fields) >= 4 {
+			cursor = fields[3]
+		}
+		kind = 'p' // 's' is taken for session
+	case "watch": // watch <prefix> [<fromVersion>]
+		checkN(fields, 2)
+		version = -1 // changes from now on
+		if len(fields) >= 3 {
+			version = toInt(2, true)
+		}
+		kind = 'h' // 'w' is taken for write
+	case "admin": // admin <command> <server id>
+		checkN(fields, 3)
+		if fatalerr == nil {
+			admin = fields[1]
+			if admin != ADMIN_TRANSFER && admin != ADMIN_PROMOTE {
+				fatalerr = fmt.Errorf("Admin command %s not recognized", admin)
+			}
+		}
+		serverId = toInt(2, false)
+	case "keepalive": // keepalive <ttl>
+		checkN(fields, 2)
+		exptime = toInt(1, false)
+	case "txn": // txn <ncompares> <nsuccess> <nfailure>
+		checkN(fields, 4)
+		compares, nsuccess, nfailure = toInt(1, false), toInt(2, false), toInt(3, false)
+		for _, n := range []int{compares, nsuccess, nfailure} {
+			if fatalerr == nil && (n < 0 || n > MAX_TXN_OPS) {
+				fatalerr = fmt.Errorf("Counts in txn must be between 0 and %d", MAX_TXN_OPS)
+			}
+		}
+	case "session": // session <client id> <seq>
+		checkN(fields, 3)
+		if fatalerr == nil {
+			if clientId, err = strconv.ParseInt(fields[1], 10, 64); err == nil {
+				seq, err = strconv.ParseInt(fields[2], 10, 64)
+			}
+			fatalerr = err
+		}
 
 	case "CONTENTS":
 		checkN(fields, 4)
@@ -143,12 +398,59 @@ func PaserString( msgstr string ) (msg *Msg, msgerr error, fatalerr error)  {
 		numbytes = toInt(2, false)
 		exptime = toInt(3, true)
 		response = true
+	case "LIST": // LIST <version> <numbytes>
+		checkN(fields, 3)
+		version = toInt(1, true)
+		numbytes = toInt(2, false)
+		response = true
+
+	case "SCAN": // SCAN <count> [<cursor>]
+		checkN(fields, 2)
+		count = toInt(1, false)
+		if fatalerr == nil && (count < 0 || count > MAX_SCAN_LIMIT) {
+			fatalerr = fmt.Errorf("Count in SCAN must be between 0 and %d", MAX_SCAN_LIMIT)
+		}
+		if len(fields) >= 3 {
+			cursor = fields[2]
+		}
+		response = true
+
+	case "HISTORY": // HISTORY <count>
+		checkN(fields, 2)
+		count = toInt(1, false)
+		if fatalerr == nil && (count < 0 || count > MAX_HISTORY+1) {
+			fatalerr = fmt.Errorf("Count in HISTORY must be between 0 and %d", MAX_HISTORY+1)
+		}
+		response = true
+	case "STAT": // STAT <created> <version> <ctime> <mtime> <size> <checksum> <owner>
+		var st Stat
+		if st, fatalerr = ParseStat(msgstr); fatalerr == nil {
+			stat = &st
+			version = st.Version
+		}
+		kind = 'A' // 'S' is taken for scan
+		response = true
+	case "TXN": // TXN success|failure <count>
+		checkN(fields, 3)
+		if fatalerr == nil && fields[1] != "success" && fields[1] != "failure" {
+			fatalerr = fmt.Errorf("Txn result %s not recognized", fields[1])
+		}
+		succeeded = fatalerr == nil && fields[1] == "success"
+		count = toInt(2, false)
+		if fatalerr == nil && (count < 0 || count > MAX_TXN_OPS) {
+			fatalerr = fmt.Errorf("Count in TXN must be between 0 and %d", MAX_TXN_OPS)
+		}
+		kind = 'Y' // 'T' is taken for ERR_IS_DIR
+		response = true
 
 	case "OK":
 		checkN(fields, 1)
 		if len(fields) > 1 {
 			version = toInt(1, true)
 		}
+		if len(fields) > 2 {
+			filename = fields[2] // name of the file created
+		}
 		response = true
 	case "ERR_VERSION":
 		checkN(fields, 2)
@@ -158,6 +460,18 @@ func PaserString( msgstr string ) (msg *Msg, msgerr error, fatalerr error)  {
 	case "ERR_FILE_NOT_FOUND":
 		kind = 'F'
 		response = true
+	case "ERR_NOT_DIR":
+		kind = 'N'
+		response = true
+	case "ERR_IS_DIR":
+		kind = 'T' // 'I' is taken for internal error
+		response = true
+	case "ERR_NOT_EMPTY":
+		kind = 'E'
+		response = true
+	case "ERR_SESSION_EXPIRED":
+		kind = 'X' // 'S' is taken for scan
+		response = true
 	case "ERR_CMD_ERR":
 		kind = 'M' // 'C' is taken for contents
 		response = true
@@ -173,14 +487,26 @@ func PaserString( msgstr string ) (msg *Msg, msgerr error, fatalerr error)  {
 		fatalerr = fmt.Errorf("Command %s not recognized", fields[0])
 	}
 	if fatalerr == nil {
-		var filename = ""
 		if kind == 0 {
 			kind = fields[0][0] // first char
 		}
-		if !response {
+		if !response && kind != 'a' && kind != 's' && kind != 'k' && kind != 't' {
 			filename = fields[1]
 		}
-		return &Msg{Kind: kind, Filename: filename, Numbytes: numbytes, Exptime: exptime, Version: version, RedirectAddr:redirect}, msgerr, nil
+		// Lists are filled by the lines following the first one
+		var entries []Entry
+		var responses []Msg
+		if kind == 'S' || kind == 'H' {
+			entries = make([]Entry, count)
+		} else if kind == 'Y' {
+			responses = make([]Msg, count)
+		}
+		var compareList []Compare
+		var success, failure []Msg
+		if kind == 't' {
+			compareList, success, failure = make([]Compare, compares), make([]Msg, nsuccess), make([]Msg, nfailure)
+		}
+		return &Msg{Kind: kind, Filename: filename, Numbytes: numbytes, Exptime: exptime, Ephemeral: ephemeral, Sequential: sequential, Version: version, Offset: offset, Length: length, ReadMode: readMode, Admin: admin, ServerId: serverId, ClientId: clientId, Seq: seq, Limit: limit, Cursor: cursor, Entries: entries, Compares: compareList, Success: success, Failure: failure, Succeeded: succeeded, Responses: responses, Stat: stat, RedirectAddr:redirect}, msgerr, nil
 	} else {
 		return nil, nil, fatalerr
 	}
@@ -206,6 +532,70 @@ func parseSecond(reader *bufio.Reader, numbytes int) (buf []byte, err error) {
 	}
 }
 
+// Reads the count entry lines of the scan response
+func parseEntries(reader *bufio.Reader, buf []byte, count int) ([]Entry, error) {
+	entries := make([]Entry, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := fillLine(buf, reader)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := ParseEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Reads the compares and the ops of the txn. Ops are plain writes and deletes, recoverable
+// errors in them are returned as msgerr
+func parseTxn(reader *bufio.Reader, buf []byte, msg *Msg) (msgerr error, fatalerr error) {
+	for i := range msg.Compares {
+		line, err := fillLine(buf, reader)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Compares[i], err = ParseCompare(line); err != nil {
+			return nil, err
+		}
+	}
+	for _, ops := range [][]Msg{msg.Success, msg.Failure} {
+		for i := range ops {
+			op, opErr, err := GetMsg(reader)
+			if err != nil {
+				return nil, err
+			}
+			if (op.Kind != 'w' && op.Kind != 'd') || op.Ephemeral || op.ClientId != 0 || op.Version != 0 {
+				return nil, fmt.Errorf("Op %c not allowed in txn", op.Kind)
+			}
+			if opErr != nil {
+				msgerr = opErr
+			}
+			ops[i] = *op
+		}
+	}
+	return msgerr, nil
+}
+
+// Reads the count response lines of the txn response
+func parseResponses(reader *bufio.Reader, buf []byte, count int) ([]Msg, error) {
+	responses := make([]Msg, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := fillLine(buf, reader)
+		if err != nil {
+			return nil, err
+		}
+		r, _, err := PaserString(line)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, *r)
+	}
+	return responses, nil
+}
+
 func fillLine(buf []byte, reader *bufio.Reader) (string, error) {
 	var err error
 	count := 0
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func mkReader(str string) *bufio.Reader {
@@ -40,6 +41,96 @@ func TestMsg_Read(t *testing.T) {
 	msgExpect(t, msg, &Msg{Kind: 'r', Filename: "foobar"}, msgerr, fatalerr)
 }
 
+func TestMsg_ReadRange(t *testing.T) {
+	msg, msgerr, fatalerr := GetMsg(mkReader("read foobar 10 20 linearizable\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'r', Filename: "foobar"}, msgerr, fatalerr)
+	if msg.Offset != 10 || msg.Length != 20 || msg.Version != 0 || msg.ReadMode != READ_LINEARIZABLE {
+		t.Fatalf("Unexpected range read : %+v", msg)
+	}
+	// Single number is a version
+	msg, msgerr, fatalerr = GetMsg(mkReader("read foobar 10 stale\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'r', Filename: "foobar"}, msgerr, fatalerr)
+	if msg.Offset != 0 || msg.Length != 0 || msg.Version != 10 {
+		t.Fatalf("Unexpected read of version : %+v", msg)
+	}
+}
+
+func TestMsg_Stat(t *testing.T) {
+	msg, msgerr, fatalerr := GetMsg(mkReader("stat /app/db linearizable\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'i', Filename: "/app/db"}, msgerr, fatalerr)
+	if msg.ReadMode != READ_LINEARIZABLE {
+		t.Fatalf("Expected read mode '%s', got '%s'", READ_LINEARIZABLE, msg.ReadMode)
+	}
+
+	stat := Stat{Created: 4, Version: 9, Ctime: time.Unix(100, 5).UTC(), Mtime: time.Unix(200, 0).UTC(), Size: 12, Checksum: 0xab01, Owner: 77}
+	msg, msgerr, fatalerr = GetMsg(mkReader(stat.String() + "\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'A'}, msgerr, fatalerr)
+	if msg.Stat == nil || *msg.Stat != stat || msg.Version != 9 {
+		t.Fatalf("Expected stat %+v, got %+v", stat, msg.Stat)
+	}
+
+	_, _, fatalerr = GetMsg(mkReader("STAT 4 9 yesterday now 12 ab01 77\r\n"))
+	if fatalerr == nil {
+		t.Fatal("Expected error for malformed times in stat")
+	}
+}
+
+func TestMsg_AppendPwrite(t *testing.T) {
+	r := mkReader("session 3 4\r\nappend /log 3\r\nabc\r\npwrite /log 2 2\r\nde\r\n")
+	msg, msgerr, fatalerr := GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'e', Filename: "/log", Contents: []byte("abc")}, msgerr, fatalerr)
+	if msg.ClientId != 3 || msg.Seq != 4 {
+		t.Fatalf("Unexpected session of append : %+v", msg)
+	}
+	msg, msgerr, fatalerr = GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'o', Filename: "/log", Contents: []byte("de")}, msgerr, fatalerr)
+	if msg.Offset != 2 {
+		t.Fatalf("Expected offset 2, got %d", msg.Offset)
+	}
+
+	_, _, fatalerr = GetMsg(mkReader("pwrite /log 2\r\n"))
+	if fatalerr == nil {
+		t.Fatal("Expected error for pwrite without numbytes")
+	}
+}
+
+func TestMsg_ReadMode(t *testing.T) {
+	r := mkReader("read foobar linearizable\r\n")
+	msg, msgerr, fatalerr := GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'r', Filename: "foobar"}, msgerr, fatalerr)
+	if msg.ReadMode != READ_LINEARIZABLE {
+		t.Fatalf("Expected read mode '%s', got '%s'", READ_LINEARIZABLE, msg.ReadMode)
+	}
+
+	r = mkReader("read foobar fresh\r\n")
+	_, _, fatalerr = GetMsg(r)
+	if fatalerr == nil {
+		t.Fatal("Expected Failure on Invalid read mode")
+	}
+}
+
+func TestMsg_Admin(t *testing.T) {
+	r := mkReader("admin transfer 3\r\n")
+	msg, msgerr, fatalerr := GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'a'}, msgerr, fatalerr)
+	if msg.Admin != ADMIN_TRANSFER || msg.ServerId != 3 {
+		t.Fatalf("Expected admin command '%s %d', got '%s %d'", ADMIN_TRANSFER, 3, msg.Admin, msg.ServerId)
+	}
+
+	r = mkReader("admin promote 6\r\n")
+	msg, msgerr, fatalerr = GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'a'}, msgerr, fatalerr)
+	if msg.Admin != ADMIN_PROMOTE || msg.ServerId != 6 {
+		t.Fatalf("Expected admin command '%s %d', got '%s %d'", ADMIN_PROMOTE, 6, msg.Admin, msg.ServerId)
+	}
+
+	r = mkReader("admin shutdown 3\r\n")
+	_, _, fatalerr = GetMsg(r)
+	if fatalerr == nil {
+		t.Fatal("Expected Failure on Invalid admin command")
+	}
+}
+
 func TestMsg_InvalidMsg(t *testing.T) {
 	r := mkReader("dummy")
 	_, _, fatalerr := GetMsg(r)
@@ -86,6 +177,192 @@ func TestMsg_Delete(t *testing.T) {
 	r := mkReader("delete xyz\r\n") //  'dummy' in place of exptime
 	msg, msgerr, fatalerr := GetMsg(r)
 	msgExpect(t, msg, &Msg{Kind: 'd', Filename: "xyz"}, msgerr, fatalerr)
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("delete xyz 12\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'd', Filename: "xyz", Version: 12}, msgerr, fatalerr)
+}
+
+func TestMsg_Directories(t *testing.T) {
+	r := mkReader("mkdir /app/config\r\n")
+	msg, msgerr, fatalerr := GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'm', Filename: "/app/config"}, msgerr, fatalerr)
+
+	r = mkReader("rmdir /app/config\r\n")
+	msg, msgerr, fatalerr = GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'x', Filename: "/app/config"}, msgerr, fatalerr)
+
+	r = mkReader("ls /app linearizable\r\n")
+	msg, msgerr, fatalerr = GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'l', Filename: "/app"}, msgerr, fatalerr)
+	if msg.ReadMode != READ_LINEARIZABLE {
+		t.Fatalf("Expected read mode %s, got %s", READ_LINEARIZABLE, msg.ReadMode)
+	}
+
+	contents := "config/\ndb"
+	r = mkReader(fmt.Sprintf("LIST 7 %d\r\n", len(contents)) + contents + "\r\n")
+	msg, msgerr, fatalerr = GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'L', Contents: []byte(contents), Numbytes: len(contents), Version: 7}, msgerr, fatalerr)
+
+	for str, kind := range map[string]byte{"ERR_NOT_DIR\r\n": 'N', "ERR_IS_DIR\r\n": 'T', "ERR_NOT_EMPTY\r\n": 'E'} {
+		msg, msgerr, fatalerr = GetMsg(mkReader(str))
+		msgExpect(t, msg, &Msg{Kind: kind}, msgerr, fatalerr)
+	}
+}
+
+func TestMsg_Scan(t *testing.T) {
+	msg, msgerr, fatalerr := GetMsg(mkReader("scan /app/ 10 /app/db\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'p', Filename: "/app/"}, msgerr, fatalerr)
+	if msg.Limit != 10 || msg.Cursor != "/app/db" {
+		t.Fatalf("Expected limit 10 and cursor /app/db, got %d %s", msg.Limit, msg.Cursor)
+	}
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("scan /app\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'p', Filename: "/app"}, msgerr, fatalerr)
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("SCAN 2 /app/log\r\n/app/db 3 9\r\n/app/log 5 0\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'S'}, msgerr, fatalerr)
+	expected := []Entry{{"/app/db", 3, 9}, {"/app/log", 5, 0}}
+	if len(msg.Entries) != 2 || msg.Entries[0] != expected[0] || msg.Entries[1] != expected[1] || msg.Cursor != "/app/log" {
+		t.Fatalf("Unexpected scan response : %+v", msg)
+	}
+
+	_, _, fatalerr = GetMsg(mkReader("SCAN 1\r\n/app/db 3\r\n"))
+	if fatalerr == nil {
+		t.Fatal("Expected error for malformed entry")
+	}
+}
+
+func TestMsg_History(t *testing.T) {
+	msg, msgerr, fatalerr := GetMsg(mkReader("read /app/db 17 linearizable\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'r', Filename: "/app/db", Version: 17}, msgerr, fatalerr)
+	if msg.ReadMode != READ_LINEARIZABLE {
+		t.Fatalf("Expected read mode %s, got %s", READ_LINEARIZABLE, msg.ReadMode)
+	}
+	msg, msgerr, fatalerr = GetMsg(mkReader("read /app/db 17\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'r', Filename: "/app/db", Version: 17}, msgerr, fatalerr)
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("history /app/db\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'v', Filename: "/app/db"}, msgerr, fatalerr)
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("HISTORY 2\r\n/app/db 17 3\r\n/app/db 9 0\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'H'}, msgerr, fatalerr)
+	if len(msg.Entries) != 2 || msg.Entries[1] != (Entry{"/app/db", 9, 0}) {
+		t.Fatalf("Unexpected history response : %+v", msg)
+	}
+}
+
+func TestMsg_Txn(t *testing.T) {
+	r := mkReader("session 3 4\r\ntxn 2 2 1\r\nversion /app/marker 7\r\nmissing /app/lock\r\n" +
+		"write /app/config 2\r\nv2\r\nwrite /app/marker 1 10\r\n8\r\ndelete /app/lock\r\nread /app/x\r\n")
+	msg, msgerr, fatalerr := GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 't'}, msgerr, fatalerr)
+	if msg.ClientId != 3 || len(msg.Compares) != 2 || len(msg.Success) != 2 || len(msg.Failure) != 1 {
+		t.Fatalf("Unexpected txn : %+v", msg)
+	}
+	if msg.Compares[0] != (Compare{COMPARE_VERSION, "/app/marker", 7}) || msg.Compares[1] != (Compare{COMPARE_MISSING, "/app/lock", 0}) {
+		t.Fatalf("Unexpected compares : %+v", msg.Compares)
+	}
+	msgExpect(t, &msg.Success[0], &Msg{Kind: 'w', Filename: "/app/config", Contents: []byte("v2")}, nil, nil)
+	msgExpect(t, &msg.Success[1], &Msg{Kind: 'w', Filename: "/app/marker", Contents: []byte("8"), Exptime: 10}, nil, nil)
+	msgExpect(t, &msg.Failure[0], &Msg{Kind: 'd', Filename: "/app/lock"}, nil, nil)
+
+	// Next command follows the txn
+	msg, msgerr, fatalerr = GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'r', Filename: "/app/x"}, msgerr, fatalerr)
+
+	// Ops are only plain writes and deletes
+	_, _, fatalerr = GetMsg(mkReader("txn 0 1 0\r\nread /app/x\r\n"))
+	if fatalerr == nil {
+		t.Fatal("Expected error for read in txn")
+	}
+	_, _, fatalerr = GetMsg(mkReader("txn 0 1 0\r\ndelete /app/x 3\r\n"))
+	if fatalerr == nil {
+		t.Fatal("Expected error for versioned delete in txn")
+	}
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("TXN failure 2\r\nOK 9\r\nOK\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'Y'}, msgerr, fatalerr)
+	if msg.Succeeded || len(msg.Responses) != 2 || msg.Responses[0].Kind != 'O' || msg.Responses[0].Version != 9 {
+		t.Fatalf("Unexpected txn response : %+v", msg)
+	}
+}
+
+func TestMsg_Create(t *testing.T) {
+	msg, msgerr, fatalerr := GetMsg(mkReader("create /queue/ 3 sequential ephemeral\r\nabc\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'n', Filename: "/queue/", Contents: []byte("abc")}, msgerr, fatalerr)
+	if !msg.Sequential || !msg.Ephemeral {
+		t.Fatalf("Expected sequential ephemeral create, got %+v", msg)
+	}
+	msg, msgerr, fatalerr = GetMsg(mkReader("create /lock 3\r\nabc\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'n', Filename: "/lock", Contents: []byte("abc")}, msgerr, fatalerr)
+	if msg.Sequential || msg.Ephemeral {
+		t.Fatalf("Expected plain create, got %+v", msg)
+	}
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("OK 12 /queue/0000000012\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'O', Version: 12, Filename: "/queue/0000000012"}, msgerr, fatalerr)
+}
+
+func TestMsg_Ephemeral(t *testing.T) {
+	msg, msgerr, fatalerr := GetMsg(mkReader("session 3 4\r\nkeepalive 30\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'k', Exptime: 30}, msgerr, fatalerr)
+	if msg.ClientId != 3 || msg.Filename != "" {
+		t.Fatalf("Unexpected keepalive : %+v", msg)
+	}
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("write /leader 3 ephemeral\r\nabc\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'w', Filename: "/leader", Contents: []byte("abc")}, msgerr, fatalerr)
+	if !msg.Ephemeral {
+		t.Fatalf("Expected ephemeral write, got %+v", msg)
+	}
+	msg, msgerr, fatalerr = GetMsg(mkReader("cas /leader 0 3 10 ephemeral\r\nabc\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'c', Filename: "/leader", Contents: []byte("abc"), Exptime: 10}, msgerr, fatalerr)
+	if !msg.Ephemeral {
+		t.Fatalf("Expected ephemeral cas, got %+v", msg)
+	}
+	msg, msgerr, fatalerr = GetMsg(mkReader("write /leader 3\r\nabc\r\n"))
+	if msg.Ephemeral {
+		t.Fatal("Expected write not to be ephemeral")
+	}
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("ERR_SESSION_EXPIRED\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'X'}, msgerr, fatalerr)
+}
+
+func TestMsg_Watch(t *testing.T) {
+	msg, msgerr, fatalerr := GetMsg(mkReader("watch /app/ 12\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'h', Filename: "/app/", Version: 12}, msgerr, fatalerr)
+
+	msg, msgerr, fatalerr = GetMsg(mkReader("watch /app/\r\n"))
+	msgExpect(t, msg, &Msg{Kind: 'h', Filename: "/app/"}, msgerr, fatalerr)
+	if msg.Version != -1 {
+		t.Fatalf("Expected version -1 for changes from now on, got %d", msg.Version)
+	}
+
+	event, err := ParseEvent("EVENT expire /app/db 7\r\n")
+	if err != nil || event != (Event{"expire", "/app/db", 7}) {
+		t.Fatalf("Unexpected event : %+v, %v", event, err)
+	}
+	if _, err = ParseEvent("OK 7\r\n"); err == nil {
+		t.Fatal("Expected error for malformed event")
+	}
+}
+
+func TestMsg_Session(t *testing.T) {
+	r := mkReader("session 4611686018427387904 7\r\nwrite foobar 3\r\nabc\r\n")
+	msg, msgerr, fatalerr := GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'w', Filename: "foobar", Contents: []byte("abc")}, msgerr, fatalerr)
+	if msg.ClientId != 4611686018427387904 || msg.Seq != 7 {
+		t.Fatalf("Expected session 4611686018427387904 7, got %d %d", msg.ClientId, msg.Seq)
+	}
+
+	// Msg without session line
+	r = mkReader("delete xyz\r\n")
+	msg, msgerr, fatalerr = GetMsg(r)
+	msgExpect(t, msg, &Msg{Kind: 'd', Filename: "xyz"}, msgerr, fatalerr)
+	if msg.ClientId != 0 || msg.Seq != 0 {
+		t.Fatalf("Expected no session, got %d %d", msg.ClientId, msg.Seq)
+	}
 }
 
 func TestMsg_RecoverableErrors(t *testing.T) {
@@ -125,6 +402,9 @@ func TestMsg_UnrecoverableErrors(t *testing.T) {
 
 	// Less fields than expected
 	checkfatal("write foobar\r\ncontents\r\nread")
+
+	// Non-numeric session
+	checkfatal("session client 1\r\ndelete xyz\r\n")
 }
 
 func TestMsg_Responses(t *testing.T) {
@@ -0,0 +1,74 @@
+package fs
+
+import (
+	"time"
+)
+
+// Appends the contents to the file, creating it if it does not exist
+func (fs *FS) processAppend(msg *Msg) *Msg {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.splice(msg, -1)
+}
+
+// Writes the contents over the file from the offset on, extending it if they go past its end.
+// Offset is at most the size of the file, files have no holes
+func (fs *FS) processPwrite(msg *Msg) *Msg {
+	if msg.Offset < 0 {
+		return &Msg{Kind: 'M'}
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.splice(msg, msg.Offset)
+}
+
+// Writes the contents of the msg into the file at the offset, -1 for its end. A missing file
+// is empty. The file keeps its expiry time, and is a new version like on any write.
+// Called with the file system locked
+func (fs *FS) splice(msg *Msg, offset int) *Msg {
+	var old []byte
+	m := *msg
+	m.Exptime, m.Absexptime, m.Ephemeral = 0, time.Time{}, false
+	if fi := fs.dir[msg.Filename]; fi != nil {
+		if fi.isDir {
+			return &Msg{Kind: 'T'} // is a directory
+		}
+		old = fi.contents
+		m.Absexptime = fi.absexptime
+	}
+	if offset < 0 {
+		offset = len(old)
+	}
+	end := offset + len(msg.Contents)
+	if offset > len(old) || end > MAX_CONTENT_SIZE {
+		return &Msg{Kind: 'M'}
+	}
+
+	if offset == len(old) {
+		// Bytes stored are not changed, so the past version in the history stays intact,
+		// and a log-like file grows without being copied on every append
+		m.Contents = append(old, msg.Contents...)
+	} else {
+		size := len(old)
+		if end > size {
+			size = end
+		}
+		m.Contents = make([]byte, size) // bytes overwritten stay in the history
+		copy(m.Contents, old)
+		copy(m.Contents[offset:], msg.Contents)
+	}
+	return fs.internalWrite(&m)
+}
+
+// Returns the length bytes of the contents from the offset on, up to the end if length is 0.
+// Offsets past the end give no bytes
+func readRange(contents []byte, offset int, length int) []byte {
+	if offset > len(contents) {
+		offset = len(contents)
+	}
+	contents = contents[offset:]
+	if length > 0 && length < len(contents) {
+		contents = contents[:length]
+	}
+	return contents
+}
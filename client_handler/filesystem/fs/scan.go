@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Number of entries in a scan response, when no limit is given, and the most allowed
+const (
+	SCAN_LIMIT     = 100
+	MAX_SCAN_LIMIT = 1000
+)
+
+// File matched by scan, sent as "<filename> <version> <size>\r\n"
+type Entry struct {
+	Filename string
+	Version  int
+	Size     int
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s %d %d", e.Filename, e.Version, e.Size)
+}
+
+// Parses the entry line of the scan response
+func ParseEntry(line string) (Entry, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return Entry{}, fmt.Errorf("Incorrect number of fields in entry : %s", line)
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Entry{}, err
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Filename: fields[0], Version: version, Size: size}, nil
+}
+
+// Returns the files whose names start with the prefix, in sorted order, after the cursor.
+// If more files match than the limit, Cursor of the response is the last name returned,
+// from which the next page continues.
+func (fs *FS) processScan(msg *Msg) *Msg {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	prefix := msg.Filename
+	if !strings.HasPrefix(prefix, ROOT) {
+		prefix = ROOT + prefix
+	}
+	limit := msg.Limit
+	if limit <= 0 {
+		limit = SCAN_LIMIT
+	} else if limit > MAX_SCAN_LIMIT {
+		limit = MAX_SCAN_LIMIT
+	}
+
+	node := fs.index.seek(prefix)
+	if msg.Cursor > prefix {
+		node = fs.index.seek(msg.Cursor)
+		if node != nil && node.key == msg.Cursor {
+			node = node.next[0]
+		}
+	}
+
+	response := &Msg{Kind: 'S', Entries: []Entry{}}
+	for ; node != nil && strings.HasPrefix(node.key, prefix); node = node.next[0] {
+		fi := fs.dir[node.key]
+		if fi.isDir {
+			continue
+		}
+		if len(response.Entries) == limit {
+			response.Cursor = response.Entries[limit-1].Filename // more to follow
+			break
+		}
+		response.Entries = append(response.Entries, Entry{Filename: fi.filename, Version: fi.version, Size: len(fi.contents)})
+	}
+	return response
+}
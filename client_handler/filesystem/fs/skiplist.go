@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"math/rand"
+)
+
+const maxLevel = 24 // Enough for 2^24 names with p = 1/2
+
+// Node of the skip list, next[i] is the next node at level i
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// Sorted set of names, an ordered index alongside the map of the file system.
+// Insert, remove and seek take O(log n) expected time.
+type skipList struct {
+	head  *skipNode
+	level int        // Number of levels in use
+	rnd   *rand.Rand // Levels only affect the speed, a fixed seed keeps replicas alike
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+func (l *skipList) randomLevel() int {
+	level := 1
+	for level < maxLevel && l.rnd.Intn(2) == 0 {
+		level++
+	}
+	return level
+}
+
+// Returns, for each level, the last node with key less than the given key
+func (l *skipList) predecessors(key string) []*skipNode {
+	update := make([]*skipNode, maxLevel)
+	node := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// Adds the key, if it is not present
+func (l *skipList) insert(key string) {
+	update := l.predecessors(key)
+	if next := update[0].next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := l.randomLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+
+	node := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+// Removes the key, if it is present
+func (l *skipList) remove(key string) {
+	update := l.predecessors(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+// Returns the first node with key greater than or equal to the given key, nil if there is none.
+// Following keys are visited through node.next[0]
+func (l *skipList) seek(key string) *skipNode {
+	return l.predecessors(key)[0].next[0]
+}
@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata of a file, sent as "STAT <created> <version> <ctime> <mtime> <size> <checksum> <owner>\r\n".
+// Times are the ones the leader assigned to the changes, so every server reports the same
+type Stat struct {
+	Created  int       // Version at which the file was created
+	Version  int       // Version of the last change
+	Ctime    time.Time // Time of the creation
+	Mtime    time.Time // Time of the last change
+	Size     int
+	Checksum uint32 // CRC-32 (IEEE) of the contents
+	Owner    int64  // Session of the ephemeral file, 0 for other files
+}
+
+func (s Stat) String() string {
+	return fmt.Sprintf("STAT %d %d %s %s %d %08x %d", s.Created, s.Version,
+		s.Ctime.UTC().Format(time.RFC3339Nano), s.Mtime.UTC().Format(time.RFC3339Nano), s.Size, s.Checksum, s.Owner)
+}
+
+// Parses the stat response line
+func ParseStat(line string) (Stat, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 8 || fields[0] != "STAT" {
+		return Stat{}, fmt.Errorf("Malformed stat : %s", line)
+	}
+	var s Stat
+	var checksum uint64
+	var err error
+	if s.Created, err = strconv.Atoi(fields[1]); err != nil {
+		return Stat{}, err
+	}
+	if s.Version, err = strconv.Atoi(fields[2]); err != nil {
+		return Stat{}, err
+	}
+	if s.Ctime, err = time.Parse(time.RFC3339Nano, fields[3]); err != nil {
+		return Stat{}, err
+	}
+	if s.Mtime, err = time.Parse(time.RFC3339Nano, fields[4]); err != nil {
+		return Stat{}, err
+	}
+	if s.Size, err = strconv.Atoi(fields[5]); err != nil {
+		return Stat{}, err
+	}
+	if checksum, err = strconv.ParseUint(fields[6], 16, 32); err != nil {
+		return Stat{}, err
+	}
+	s.Checksum = uint32(checksum)
+	if s.Owner, err = strconv.ParseInt(fields[7], 10, 64); err != nil {
+		return Stat{}, err
+	}
+	return s, nil
+}
+
+// Returns the metadata of the file or directory. The checksum is computed here, stat is
+// much rarer than the writes
+func (fs *FS) processStat(msg *Msg) *Msg {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	fi := fs.dir[msg.Filename]
+	if fi == nil {
+		return &Msg{Kind: 'F'} // file not found
+	}
+	stat := &Stat{
+		Created:  fi.created,
+		Version:  fi.version,
+		Ctime:    fi.ctime,
+		Mtime:    fi.mtime,
+		Size:     len(fi.contents),
+		Checksum: crc32.ChecksumIEEE(fi.contents),
+		Owner:    fi.owner,
+	}
+	return &Msg{Kind: 'A', Filename: fi.filename, Version: fi.version, Stat: stat}
+}
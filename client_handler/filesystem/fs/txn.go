@@ -0,0 +1,156 @@
+package fs
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Most compares, and most ops in each branch, of a txn
+const MAX_TXN_OPS = 100
+
+// Targets of the compares of a txn
+const (
+	COMPARE_VERSION = "version" // File exists, at the version
+	COMPARE_EXISTS  = "exists"
+	COMPARE_MISSING = "missing"
+)
+
+// Condition of a txn, sent as "version <filename> <version>\r\n",
+// "exists <filename>\r\n" or "missing <filename>\r\n"
+type Compare struct {
+	Target   string
+	Filename string
+	Version  int
+}
+
+func (c Compare) String() string {
+	if c.Target == COMPARE_VERSION {
+		return fmt.Sprintf("%s %s %d", c.Target, c.Filename, c.Version)
+	}
+	return c.Target + " " + c.Filename
+}
+
+// Parses the compare line of the txn
+func ParseCompare(line string) (Compare, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 3 && fields[0] == COMPARE_VERSION {
+		version, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return Compare{}, err
+		}
+		return Compare{Target: fields[0], Filename: fields[1], Version: version}, nil
+	}
+	if len(fields) == 2 && (fields[0] == COMPARE_EXISTS || fields[0] == COMPARE_MISSING) {
+		return Compare{Target: fields[0], Filename: fields[1]}, nil
+	}
+	return Compare{}, fmt.Errorf("Malformed compare : %s", line)
+}
+
+// Applies the success ops if all the compares hold, the failure ops otherwise, under a single
+// lock. Ops are applied only if all of them succeed; otherwise none is, and the error of the
+// first failing op is returned.
+func (fs *FS) processTxn(msg *Msg) *Msg {
+	fs.Lock()
+	defer fs.Unlock()
+
+	succeeded := true
+	for _, c := range msg.Compares {
+		if !fs.holds(c) {
+			succeeded = false
+			break
+		}
+	}
+	branch := msg.Success
+	if !succeeded {
+		branch = msg.Failure
+	}
+
+	ops := make([]Msg, len(branch)) // ops of the msg in the logs are not to be changed
+	for i, op := range branch {
+		op.Filename = cleanPath(op.Filename)
+		op.Time = msg.Time // ops are changes at the time of the txn
+		ops[i] = op
+	}
+	if errMsg := fs.checkOps(ops); errMsg != nil {
+		return errMsg
+	}
+
+	response := &Msg{Kind: 'Y', Succeeded: succeeded, Responses: make([]Msg, 0, len(ops))}
+	for i := range ops {
+		var r *Msg
+		if ops[i].Kind == 'w' {
+			r = fs.internalWrite(&ops[i])
+		} else {
+			fs.gversion += 1
+			fs.remove(fs.dir[ops[i].Filename], ops[i].Kind)
+			r = ok(0)
+		}
+		response.Responses = append(response.Responses, *r)
+	}
+	return response
+}
+
+func (fs *FS) holds(c Compare) bool {
+	fi := fs.dir[cleanPath(c.Filename)]
+	switch c.Target {
+	case COMPARE_VERSION:
+		return fi != nil && !fi.isDir && fi.version == c.Version
+	case COMPARE_EXISTS:
+		return fi != nil
+	default:
+		return fi == nil
+	}
+}
+
+// Returns the error of the first op which would fail, applied in order, nil if all would succeed.
+// Ops only write files and delete, so the names written and deleted by the earlier ops are enough
+// to know what exists when an op is applied.
+func (fs *FS) checkOps(ops []Msg) *Msg {
+	written := map[string]bool{}
+	deleted := map[string]bool{}
+	exists := func(name string) (found bool, isDir bool) {
+		if written[name] {
+			return true, false
+		}
+		for n := name; ; n = path.Dir(n) {
+			if deleted[n] && name != ROOT { // root is only emptied
+				return false, false // deleted by itself, or along with its directory
+			}
+			if n == ROOT {
+				break
+			}
+		}
+		fi := fs.dir[name]
+		return fi != nil, fi != nil && fi.isDir
+	}
+
+	for _, op := range ops {
+		found, isDir := exists(op.Filename)
+		if op.Kind == 'd' {
+			if !found {
+				return &Msg{Kind: 'F'} // file not found
+			}
+			deleted[op.Filename] = true
+			for name := range written {
+				if op.Filename == ROOT || name == op.Filename || strings.HasPrefix(name, op.Filename+"/") {
+					delete(written, name)
+				}
+			}
+			continue
+		}
+
+		if isDir {
+			return &Msg{Kind: 'T'} // is a directory
+		} else if !found {
+			if found, isDir = exists(path.Dir(op.Filename)); !found {
+				return &Msg{Kind: 'F'} // parent not found
+			} else if !isDir {
+				return &Msg{Kind: 'N'} // parent is a file
+			}
+		}
+		written[op.Filename] = true
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of recent events kept, from which watches resume. A watcher
+// falling behind by more than this many events is closed
+const EVENT_HISTORY = 1000
+
+// Types of the events, by kind of the msg which caused them
+var eventTypes = map[byte]string{
+	'w': "write",
+	'c': "cas",
+	'n': "create",
+	'e': "append",
+	'o': "pwrite",
+	'd': "delete",
+	'D': "expire",
+	'm': "mkdir",
+	'x': "rmdir",
+	'k': "delete", // session ended by the client
+	'K': "expire", // lease of the session expired
+}
+
+// Change of a file, sent as "EVENT <type> <filename> <version>\r\n". Version is the global
+// version of the change; all the files removed by a recursive delete share one
+type Event struct {
+	Type     string
+	Filename string
+	Version  int
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("EVENT %s %s %d", e.Type, e.Filename, e.Version)
+}
+
+// Parses the event line pushed to the watch
+func ParseEvent(line string) (Event, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "EVENT" {
+		return Event{}, fmt.Errorf("Malformed event : %s", line)
+	}
+	version, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Type: fields[1], Filename: fields[2], Version: version}, nil
+}
+
+// Subscription to the changes of the files whose names start with a prefix
+type Watcher struct {
+	prefix  string
+	lock    sync.Mutex
+	pending []Event
+	closed  bool
+	Ready   chan struct{} // Signalled when events are pending, or the watcher is closed
+}
+
+// Returns the pending events; ok is false once the watcher is closed, the events pending
+// until then are still returned along with it
+func (w *Watcher) Next() (events []Event, ok bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	events, w.pending = w.pending, nil
+	return events, !w.closed
+}
+
+func (w *Watcher) push(event Event) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	if len(w.pending) >= EVENT_HISTORY {
+		w.closed = true // too far behind, client resumes from its last event
+	} else {
+		w.pending = append(w.pending, event)
+	}
+	w.signal()
+}
+
+func (w *Watcher) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	w.signal()
+}
+
+func (w *Watcher) signal() {
+	select {
+	case w.Ready <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// Registers the watch of the prefix. Events after fromVersion are replayed from the history,
+// -1 watches the changes from now on. Returns the watcher and OK with the current version, or
+// ERR_VERSION with the current version if the events after fromVersion are no longer kept.
+func (fs *FS) Watch(prefix string, fromVersion int) (*Watcher, *Msg) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if !strings.HasPrefix(prefix, ROOT) {
+		prefix = ROOT + prefix
+	}
+	if fromVersion < 0 {
+		fromVersion = fs.gversion
+	} else if fromVersion < fs.evicted {
+		return nil, &Msg{Kind: 'V', Version: fs.gversion}
+	}
+
+	w := &Watcher{prefix: prefix, Ready: make(chan struct{}, 1)}
+	for _, event := range fs.events {
+		if event.Version > fromVersion && strings.HasPrefix(event.Filename, prefix) {
+			w.push(event)
+		}
+	}
+	fs.watchers[w] = true
+	return w, ok(fs.gversion)
+}
+
+// Deregisters the watcher
+func (fs *FS) Unwatch(w *Watcher) {
+	fs.Lock()
+	defer fs.Unlock()
+	delete(fs.watchers, w)
+	w.close()
+}
+
+// Records the change of the file at the current version, and pushes it to the watchers.
+// Called with the file system locked
+func (fs *FS) record(kind byte, filename string) {
+	event := Event{Type: eventTypes[kind], Filename: filename, Version: fs.gversion}
+	fs.events = append(fs.events, event)
+	if len(fs.events) > EVENT_HISTORY {
+		fs.evicted = fs.events[0].Version
+		fs.events = fs.events[1:]
+	}
+	for w := range fs.watchers {
+		if strings.HasPrefix(filename, w.prefix) {
+			w.push(event)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package client_handler
+
+import (
+    "sync/atomic"
+    "time"
+    "github.com/avg598/cs733/client_handler/raft_node"
+    rsm "github.com/avg598/cs733/client_handler/raft_node/raft_state_machine"
+)
+
+/*
+ *  Request forwarded by a follower to the leader, on behalf of its client
+ */
+type ForwardRequest struct {
+    ReqId    int            // Request id on the follower, returned back with the response
+    ClientId int64          // Session of the client
+    Seq      int64
+    Data     interface{}
+}
+
+/*
+ *  Response of the leader to the forwarded request
+ */
+type ForwardResponse struct {
+    ReqId     int
+    Response  interface{}
+    NotLeader bool          // Target of the request was not the leader
+    LeaderId  int           // Leader known by the target, if it was not the leader
+    Failed    bool          // Request could not be committed
+}
+
+/***
+ *  Forward the request to the leader over the cluster transport, and wait for its response.
+ *  Returns the response of the service, or the error with which the leader failed the request
+ */
+func (chd *ClientHandler) forward(leaderId int, clientId int64, seq int64, data interface{}) (interface{}, error) {
+    reqId, waitChan := chd.RegisterRequest()
+
+    chd.log_info(3, "Forwarding request %v to leader %v", reqId, leaderId)
+    chd.Raft.Send(leaderId, ForwardRequest{ReqId: reqId, ClientId: clientId, Seq: seq, Data: data})
+
+    select {
+    case res, ok := <-waitChan:
+        if !ok {
+            return nil, ErrShutdown                 // Deregistered by shutdown
+        }
+        chd.DeregisterRequest(reqId)
+        return res.Response, res.Err
+    case <-time.After(CONNECTION_TIMEOUT):
+        chd.DeregisterRequest(reqId)
+        return nil, ErrTimeout
+    }
+}
+
+/***
+ *  Handle message received from the client handler of another node
+ */
+func (chd *ClientHandler) handleMessage(msg raft_node.Message) {
+    switch msg.Data.(type) {
+    case ForwardRequest:
+        go chd.serveForward(msg.FromId, msg.Data.(ForwardRequest))
+    case ForwardResponse:
+        resp := msg.Data.(ForwardResponse)
+        res := result{Response: resp.Response}
+        if resp.NotLeader {
+            res.Err = rsm.Error_NotLeader{LeaderId: resp.LeaderId}
+        } else if resp.Failed {
+            res.Err = rsm.Error_Commit{}
+        }
+        chd.SendToWaitCh(resp.ReqId, res)
+    default:
+        chd.log_error(3, "Unknown message from %v : %+v", msg.FromId, msg.Data)
+    }
+}
+
+/***
+ *  Forward the writes to the leader, instead of redirecting the client, from now on.
+ *  Safe to call while the clients are being served
+ */
+func (chd *ClientHandler) SetForwardWrites(forward bool) {
+    value := int32(0)
+    if forward {
+        value = 1
+    }
+    atomic.StoreInt32(&chd.forwardWrites, value)
+}
+
+func (chd *ClientHandler) forwarding() bool {
+    return atomic.LoadInt32(&chd.forwardWrites) == 1
+}
+
+/***
+ *  Replicate the request forwarded by the follower and send it the response. Request is not
+ *  forwarded further, if this node is no longer the leader the follower redirects its client
+ */
+func (chd *ClientHandler) serveForward(fromId int, req ForwardRequest) {
+    response, err := chd.SubmitSession(req.ClientId, req.Seq, req.Data)
+
+    resp := ForwardResponse{ReqId: req.ReqId, Response: response}
+    if err != nil {
+        if notLeader, ok := err.(rsm.Error_NotLeader); ok {
+            resp.NotLeader = true
+            resp.LeaderId  = notLeader.LeaderId
+        } else {
+            resp.Failed = true
+        }
+    }
+    chd.Raft.Send(fromId, resp)
+}
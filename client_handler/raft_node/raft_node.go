@@ -8,6 +8,8 @@ import (
     "sync"
     "strconv"
     "fmt"
+    "os"
+    "errors"
     "path"
     rsm "github.com/avg598/cs733/client_handler/raft_node/raft_state_machine"
     "github.com/avg598/cs733/logging"
@@ -30,6 +32,14 @@ func (rn RaftNode) log_warning(skip int, format string, args ...interface{}) {
 }
 
 
+/*
+ *  Message between the clients of raft nodes, carried over the cluster transport
+ */
+type Message struct {
+    FromId int
+    Data   interface{}
+}
+
 type RaftNode struct {
     eventCh       chan interface{}      // Event channel for client requests
 
@@ -41,6 +51,7 @@ type RaftNode struct {
 
     CommitChannel chan rsm.CommitAction // A channel for client to listen on.
                                         // What goes into Append must come out of here at some point.
+    MessageChannel chan Message         // Messages sent by the clients of other raft nodes
     shutDownChan  chan int              // Closing this channel will force raft thread to exit
     isUp          bool                  // Is raft running?
     isInitialized bool                  // Is raft initialized?
@@ -61,6 +72,63 @@ func (rn *RaftNode) Append(data interface{}) {
 func (rn *RaftNode) UpdateLastApplied(index int64) {
     rn.eventCh <- rsm.UpdateLastAppliedEvent{Index: index}
 }
+// When client has captured its state applied up to index, logs up to index are compacted
+func (rn *RaftNode) Snapshot(index int64, data []byte) {
+    rn.eventCh <- rsm.SnapshotEvent{Index: index, Data: data}
+}
+// Add server to the cluster, it must be present in the cluster config to be reachable.
+// Final configuration comes out of CommitChannel once committed, or the request with an error
+func (rn *RaftNode) AddServer(id int) {
+    rn.eventCh <- rsm.AddServerEvent{Id: id}
+}
+// Remove server from the cluster
+func (rn *RaftNode) RemoveServer(id int) {
+    rn.eventCh <- rsm.RemoveServerEvent{Id: id}
+}
+// Add server to the cluster as learner, it receives the logs but does not vote
+func (rn *RaftNode) AddLearner(id int) {
+    rn.eventCh <- rsm.AddLearnerEvent{Id: id}
+}
+// Promote learner to voting member, once it has caught up with the committed logs
+func (rn *RaftNode) PromoteLearner(id int) {
+    rn.eventCh <- rsm.PromoteLearnerEvent{Id: id}
+}
+// Returns index up to which logs must be applied before serving a linearizable read.
+// Only leader serves it, after confirming its leadership with majority of the cluster
+func (rn *RaftNode) ReadIndex(timeout time.Duration) (int64, error) {
+    replyCh := make(chan rsm.ReadIndexAction, 1)   // Buffered, reply is not awaited after timeout
+    rn.eventCh <- rsm.ReadIndexEvent{Data: replyCh}
+
+    select {
+    case reply := <-replyCh:
+        return reply.Index, reply.Err
+    case <-time.After(timeout):
+        return -1, errors.New("Leadership not confirmed before timeout")
+    }
+}
+// Transfer the leadership to given node, returns once this node is no longer the leader.
+// Leader rejects new appends while the target catches up, transfer fails if it does not
+// take over within election timeout
+func (rn *RaftNode) TransferLeadership(targetId int) error {
+    replyCh := make(chan rsm.TransferLeadershipAction, 1)  // Buffered, reply is not awaited after shutdown
+    rn.eventCh <- rsm.TransferLeadershipEvent{Id: targetId, Data: replyCh}
+
+    select {
+    case reply := <-replyCh:
+        return reply.Err
+    case <-rn.shutDownChan:
+        return errors.New("Raft node is shut down")
+    }
+}
+
+// Send message to the client of raft node toId, over the cluster transport.
+// Message is not replicated, it may be lost. Data must be registered to gob
+func (rn *RaftNode) Send(toId int, data interface{}) {
+    if !rn.IsNodeUp() {
+        return
+    }
+    rn.clusterServer.Outbox() <- &cluster.Envelope{Pid:toId, Msg:Message{FromId: rn.GetId(), Data: data}}
+}
 
 func (rn *RaftNode) processEvents() {
     rn.waitShutdown.Add(1)
@@ -80,6 +148,9 @@ func (rn *RaftNode) processEvents() {
     // Using heartbeat for first timer start to quick start
     rn.timer = time.NewTimer(time.Duration(rn.server_state.HeartbeatTimeout + rand.Intn(rn.server_state.HeartbeatTimeout)) * time.Millisecond)
     rn.isUp = true
+
+    // Re-apply logs which were applied before restart but are not in the snapshot
+    rn.doActions(rn.server_state.ReplayCommitted())
     for {
         var ev interface{}
         select {
@@ -90,7 +161,7 @@ func (rn *RaftNode) processEvents() {
             ev := ev.(*cluster.Envelope)
 
             // One response event for each node
-            appendRspList := make([]*rsm.AppendRequestRespEvent, rn.server_state.GetNumberOfNodes())
+            appendRspList := make(map[int]*rsm.AppendRequestRespEvent)
             //For all other events
             messages := []interface{}{}
 
@@ -116,12 +187,31 @@ func (rn *RaftNode) processEvents() {
                 case rsm.RequestVoteRespEvent :
                     rn.log_info(3, "%25v %2v <<-- %-14v %+v", reflect.TypeOf(ev.Msg).Name(), rn.GetId(), ev.Pid, ev.Msg)
 
+                    messages = append(messages, ev.Msg)
+                case rsm.PreVoteEvent, rsm.PreVoteRespEvent, rsm.TimeoutNowEvent :
+                    rn.log_info(3, "%25v %2v <<-- %-14v %+v", reflect.TypeOf(ev.Msg).Name(), rn.GetId(), ev.Pid, ev.Msg)
+
+                    messages = append(messages, ev.Msg)
+                case rsm.InstallSnapshotEvent :
+                    installEvent := ev.Msg.(rsm.InstallSnapshotEvent)
+                    rn.log_info(3, "%25v %2v <<-- %-14v index:%v offset:%v length:%v", reflect.TypeOf(ev.Msg).Name(), rn.GetId(), ev.Pid, installEvent.LastIncludedIndex, installEvent.Offset, len(installEvent.Data))
+
+                    messages = append(messages, ev.Msg)
+                case rsm.InstallSnapshotRespEvent :
+                    rn.log_info(3, "%25v %2v <<-- %-14v %+v", reflect.TypeOf(ev.Msg).Name(), rn.GetId(), ev.Pid, ev.Msg)
+
                     messages = append(messages, ev.Msg)
                 case rsm.AppendRequestRespEvent:
                     rn.log_info(3, "%25v %2v <<-- %-14v %+v", reflect.TypeOf(ev.Msg).Name(), rn.GetId(), ev.Pid, ev.Msg)
 
                     respEv := ev.Msg.(rsm.AppendRequestRespEvent)
-                    appendRspList[respEv.FromId-1] = &respEv        // Store latest response event, replace old one
+                    appendRspList[respEv.FromId] = &respEv          // Store latest response event, replace old one
+                case Message:
+                    select {
+                    case rn.MessageChannel <- ev.Msg.(Message):
+                    default:
+                        rn.log_warning(3, "Message channel is full, dropping message from %v", ev.Pid)
+                    }
                 }
 
                 if count>=rsm.BATCHSIZE {
@@ -139,10 +229,8 @@ func (rn *RaftNode) processEvents() {
             rn.log_info(3, "Cluster messages received of length %v", count)
             // All append resp events
             for _, m := range appendRspList {
-                if m !=nil {
-                    act := rn.server_state.ProcessEvent(*m)
-                    rn.doActions(act)
-                }
+                act := rn.server_state.ProcessEvent(*m)
+                rn.doActions(act)
             }
 
             // All other events
@@ -167,6 +255,10 @@ func (rn *RaftNode) processEvents() {
             // Get batch of max BATCHSIZE requests
             appendEvents     := []rsm.AppendEvent{}
             lastAppliedEvent := rsm.UpdateLastAppliedEvent{}
+            snapshotEvents   := []rsm.SnapshotEvent{}
+            configEvents     := []interface{}{}
+            readEvents       := []rsm.ReadIndexEvent{}
+            transferEvents   := []rsm.TransferLeadershipEvent{}
 
         RequestFetcherLoop:
             for count:=1 ;  ; count++{
@@ -178,6 +270,14 @@ func (rn *RaftNode) processEvents() {
                     if lastAppliedEvent.Index < ev.(rsm.UpdateLastAppliedEvent).Index {
                         lastAppliedEvent = ev.(rsm.UpdateLastAppliedEvent)
                     }
+                case rsm.SnapshotEvent:
+                    snapshotEvents = append(snapshotEvents, ev.(rsm.SnapshotEvent))
+                case rsm.AddServerEvent, rsm.RemoveServerEvent, rsm.AddLearnerEvent, rsm.PromoteLearnerEvent:
+                    configEvents = append(configEvents, ev)
+                case rsm.ReadIndexEvent:
+                    readEvents = append(readEvents, ev.(rsm.ReadIndexEvent))
+                case rsm.TransferLeadershipEvent:
+                    transferEvents = append(transferEvents, ev.(rsm.TransferLeadershipEvent))
                 }
 
                 if count>=rsm.BATCHSIZE {
@@ -199,11 +299,29 @@ func (rn *RaftNode) processEvents() {
                 actions = rn.server_state.ProcessEvent(&appendEvents)
             }
 
-            if lastAppliedEvent.Index > 0 {
+            for _, configEvent := range configEvents {
+                actions = append(actions, rn.server_state.ProcessEvent(configEvent)...)
+            }
+
+            for _, readEvent := range readEvents {
+                actions = append(actions, rn.server_state.ProcessEvent(readEvent)...)
+            }
+
+            for _, transferEvent := range transferEvents {
+                actions = append(actions, rn.server_state.ProcessEvent(transferEvent)...)
+            }
+
+            // Updates queued by client before a snapshot was installed are stale
+            if lastAppliedEvent.Index > rn.server_state.LastApplied {
                 rn.server_state.LastApplied = lastAppliedEvent.Index
                 rn.log_info(3, "Update lastApplied to %v", rn.server_state.LastApplied)
                 stateStoreAction := rn.server_state.GetStateStoreAction()
-                actions = []interface{}{stateStoreAction}
+                actions = append(actions, stateStoreAction)
+            }
+
+            // Snapshots are taken after applying logs, so process them after lastApplied is updated
+            for _, snapshotEvent := range snapshotEvents {
+                actions = append(actions, rn.server_state.ProcessEvent(snapshotEvent)...)
             }
 
             rn.doActions(actions)
@@ -257,6 +375,13 @@ func (rn *RaftNode) doActions(actions [] interface{}) {
                 rn.log_info(3, "%25v %2v -->> %-14v %+v", reflect.TypeOf(action.Event).Name(), rn.GetId(), action.ToId, action.Event)
             case rsm.RequestVoteRespEvent :
                 rn.log_info(3, "%25v %2v -->> %-14v %+v", reflect.TypeOf(action.Event).Name(), rn.GetId(), action.ToId, action.Event)
+            case rsm.PreVoteEvent, rsm.PreVoteRespEvent, rsm.TimeoutNowEvent :
+                rn.log_info(3, "%25v %2v -->> %-14v %+v", reflect.TypeOf(action.Event).Name(), rn.GetId(), action.ToId, action.Event)
+            case rsm.InstallSnapshotEvent :
+                installEvent := action.Event.(rsm.InstallSnapshotEvent)
+                rn.log_info(3, "%25v %2v -->> %-14v index:%v offset:%v length:%v", reflect.TypeOf(action.Event).Name(), rn.GetId(), action.ToId, installEvent.LastIncludedIndex, installEvent.Offset, len(installEvent.Data))
+            case rsm.InstallSnapshotRespEvent :
+                rn.log_info(3, "%25v %2v -->> %-14v %+v", reflect.TypeOf(action.Event).Name(), rn.GetId(), action.ToId, action.Event)
             }
 
             if action.ToId == -1 {
@@ -273,6 +398,20 @@ func (rn *RaftNode) doActions(actions [] interface{}) {
             //rn.log_info(3, "commitAction received  for index %v", action.Log.Index)
             rn.CommitChannel <- action
 
+        /*
+         *  Read index action
+         */
+        case rsm.ReadIndexAction :
+            action := action.(rsm.ReadIndexAction)
+            action.Data.(chan rsm.ReadIndexAction) <- action
+
+        /*
+         *  Leadership transfer action
+         */
+        case rsm.TransferLeadershipAction :
+            action := action.(rsm.TransferLeadershipAction)
+            action.Data.(chan rsm.TransferLeadershipAction) <- action
+
         /*
          *  Alarm action
          */
@@ -289,6 +428,15 @@ func (rn *RaftNode) doActions(actions [] interface{}) {
             statePath := path.Clean(rn.LogDir + "/raft_" + strconv.Itoa(rn.GetId()) + "/" + rsm.RaftStateFile)
             stateStore.State.ToServerStateFile(statePath)
             //rn.log_info(3, "state store received")
+
+        /*
+         *  Discard log action
+         */
+        case rsm.DiscardLogAction:
+            action := action.(rsm.DiscardLogAction)
+            if err := os.RemoveAll(action.Path); err != nil {
+                rn.log_error(3, "Unable to remove compacted logs %v : %v", action.Path, err.Error())
+            }
         default:
             rn.log_error(3, "Unknown action received : %v", action)
         }
@@ -333,6 +481,26 @@ func (rn *RaftNode) GetLogAt(index int64) *rsm.LogEntry {
     return rn.server_state.GetLogAt(index)
 }
 
+// Returns active configuration of the cluster
+func (rn *RaftNode) GetConfig() rsm.ConfigEntry {
+    if ! rn.IsNodeInitialized() {
+        logging.Warning(3, "Node not initialized")
+        return rsm.ConfigEntry{}
+    }
+
+    return rn.server_state.GetConfig()
+}
+
+// Returns latest snapshot of this node, nil if there is none
+func (rn *RaftNode) GetSnapshot() *rsm.Snapshot {
+    if ! rn.IsNodeInitialized() {
+        logging.Warning(3, "Node not initialized")
+        return nil
+    }
+
+    return rn.server_state.GetSnapshot()
+}
+
 func (rn *RaftNode) GetCurrentTerm() int {
     if rn.IsNodeInitialized() {
         return rn.server_state.GetCurrentTerm()
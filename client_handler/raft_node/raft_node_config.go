@@ -30,6 +30,7 @@ func NewRaftNode(Id int, config *raft_config.Config) *RaftNode {
         clusterServer       : clusterServer,
         eventCh             : make(chan interface{}, 500),   // TODO:: change size to 500
         CommitChannel       : make(chan rsm.CommitAction, 20000),
+        MessageChannel      : make(chan Message, 1000),
         shutDownChan        : make(chan int),
         LogDir              : config.LogDir,
         isUp                : false,
@@ -56,6 +57,7 @@ func RestoreServerState(Id int, config *raft_config.Config) *RaftNode {
         clusterServer       : clusterServer,
         eventCh             : make(chan interface{}, 500),
         CommitChannel       : make(chan rsm.CommitAction, 20000),
+        MessageChannel      : make(chan Message, 1000),
         shutDownChan        : make(chan int),
         LogDir              : config.LogDir,
         isUp                : false,
@@ -72,7 +74,15 @@ func goregister() {
     gob.Register(rsm.AppendRequestRespEvent{})
     gob.Register(rsm.RequestVoteEvent{})
     gob.Register(rsm.RequestVoteRespEvent{})
+    gob.Register(rsm.PreVoteEvent{})
+    gob.Register(rsm.PreVoteRespEvent{})
+    gob.Register(rsm.TimeoutNowEvent{})
+    gob.Register(rsm.InstallSnapshotEvent{})
+    gob.Register(rsm.InstallSnapshotRespEvent{})
+    gob.Register(Message{})
     //gob.Register(rsm.TimeoutEvent{})          // Not sending timeout event, no need to register
     gob.Register(rsm.AppendEvent{})
     gob.Register(rsm.LogEntry{})
+    gob.Register(rsm.ConfigEntry{})
+    gob.Register(rsm.NoOp{})
 }
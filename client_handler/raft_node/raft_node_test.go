@@ -6,6 +6,8 @@ import (
     "math/rand"
     "strconv"
     "encoding/gob"
+    "fmt"
+    rsm "github.com/avg598/cs733/client_handler/raft_node/raft_state_machine"
 )
  type TestStruct struct {
      Num int
@@ -154,6 +156,430 @@ func TestServerStateRestore2(t *testing.T) {
 }
 
 
+func TestSnapshotRestore(t *testing.T) {
+    cleanupLogs()
+    rafts := makeRafts() // array of []RaftNode
+
+    ldr := rafts.getLeader(t)
+
+    for i, retries := 1,1 ; i<=10 ;{
+        ldr = rafts.getLeader(t)
+        ldr.Append(strconv.Itoa(i))
+        err := rafts.checkSingleCommit(t, strconv.Itoa(i))
+        if err != nil {
+            log_warning(3, "Committing msg : %v failed", strconv.Itoa(i))
+            retries++
+            if retries>10 {
+                rafts.shutdownRafts()
+                t.Fatalf("Failed to commit a msg, %v, after 10 retries", strconv.Itoa(i))
+            }
+            continue
+        }
+        i++
+    }
+
+    ldr = rafts.getLeader(t)
+    ldr_id := ldr.GetId()
+    ldr_index := ldr_id - 1
+
+    // Compact logs up to 5th log
+    ldr.Snapshot(5, []byte("state at 5"))
+    time.Sleep(1*time.Second)
+    ldr.Shutdown()
+
+    rafts.restoreRaft(t, ldr_id)
+    time.Sleep(3*time.Second)
+
+    snapshot := rafts[ldr_index].GetSnapshot()
+    if snapshot == nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Snapshot not restored")
+    }
+    expect(t, snapshot.LastIncludedIndex, int64(5), "Snapshot index mismatch after restarting server")
+    expect(t, string(snapshot.Data), "state at 5", "Snapshot data mismatch after restarting server")
+    expect(t, rafts[ldr_index].GetLogAt(6).Data, "6", "Log mismatch after restarting server")
+    expect(t, rafts[ldr_index].GetLogAt(10).Data, "10", "Log mismatch after restarting server")
+
+    rafts.shutdownRafts()
+}
+
+
+func TestInstallSnapshot(t *testing.T) {
+    cleanupLogs()
+    rafts := makeRafts() // array of []RaftNode
+
+    ldr := rafts.getLeader(t)
+
+    for i, retries := 1,1 ; i<=5 ;{
+        ldr = rafts.getLeader(t)
+        ldr.Append(strconv.Itoa(i))
+        err := rafts.checkSingleCommit(t, strconv.Itoa(i))
+        if err != nil {
+            log_warning(3, "Committing msg : %v failed", strconv.Itoa(i))
+            retries++
+            if retries>10 {
+                rafts.shutdownRafts()
+                t.Fatalf("Failed to commit a msg, %v, after 10 retries", strconv.Itoa(i))
+            }
+            continue
+        }
+        i++
+    }
+
+    // Shutdown a follower, it misses logs which are compacted by the leader
+    ldr = rafts.getLeader(t)
+    follower_id := ldr.GetId() % len(rafts) + 1
+    follower_index := follower_id - 1
+    rafts[follower_index].Shutdown()
+
+    for i, retries := 6,1 ; i<=10 ;{
+        ldr = rafts.getLeader(t)
+        ldr.Append(strconv.Itoa(i))
+        err := rafts.checkSingleCommit(t, strconv.Itoa(i))
+        if err != nil {
+            log_warning(3, "Committing msg : %v failed", strconv.Itoa(i))
+            retries++
+            if retries>10 {
+                rafts.shutdownRafts()
+                t.Fatalf("Failed to commit a msg, %v, after 10 retries", strconv.Itoa(i))
+            }
+            continue
+        }
+        i++
+    }
+
+    ldr = rafts.getLeader(t)
+    ldr.Snapshot(10, []byte("state at 10"))
+    time.Sleep(1*time.Second)
+
+    // Follower can catch up only through leader's snapshot
+    rafts.restoreRaft(t, follower_id)
+    select {
+    case ci := <-rafts[follower_index].CommitChannel:
+        snapshot, ok := ci.Data.(rsm.Snapshot)
+        if !ok {
+            rafts.shutdownRafts()
+            t.Fatalf("Expected snapshot to be committed, found %v", ci.Data)
+        }
+        expect(t, snapshot.LastIncludedIndex, int64(10), "Installed snapshot index mismatch")
+        expect(t, string(snapshot.Data), "state at 10", "Installed snapshot data mismatch")
+    case <-time.After(10*time.Second):
+        rafts.shutdownRafts()
+        t.Fatalf("Snapshot not installed on lagging follower")
+    }
+
+    // Follower continues with logs after the snapshot
+    for i, retries := 11,1 ; i<=12 ;{
+        ldr = rafts.getLeader(t)
+        ldr.Append(strconv.Itoa(i))
+        err := rafts.checkSingleCommit(t, strconv.Itoa(i))
+        if err != nil {
+            log_warning(3, "Committing msg : %v failed", strconv.Itoa(i))
+            retries++
+            if retries>10 {
+                rafts.shutdownRafts()
+                t.Fatalf("Failed to commit a msg, %v, after 10 retries", strconv.Itoa(i))
+            }
+            continue
+        }
+        i++
+    }
+    expect(t, rafts[follower_index].GetLogAt(12).Data, "12", "Log mismatch after installing snapshot")
+
+    // Update of last applied queued before the snapshot is ignored, follower restarts from the snapshot
+    rafts[follower_index].UpdateLastApplied(12)
+    time.Sleep(500*time.Millisecond)
+    rafts[follower_index].UpdateLastApplied(3)
+    time.Sleep(500*time.Millisecond)
+    rafts[follower_index].Shutdown()
+    rafts.restoreRaft(t, follower_id)
+
+    for i, retries := 13,1 ; i<=13 ;{
+        ldr = rafts.getLeader(t)
+        ldr.Append(strconv.Itoa(i))
+        err := rafts.checkSingleCommit(t, strconv.Itoa(i))
+        if err != nil {
+            log_warning(3, "Committing msg : %v failed", strconv.Itoa(i))
+            retries++
+            if retries>10 {
+                rafts.shutdownRafts()
+                t.Fatalf("Failed to commit a msg, %v, after 10 retries", strconv.Itoa(i))
+            }
+            continue
+        }
+        i++
+    }
+    expect(t, rafts[follower_index].GetLogAt(13).Data, "13", "Log mismatch after restarting follower")
+
+    rafts.shutdownRafts()
+}
+
+
+func TestMembershipChange(t *testing.T) {
+    cleanupLogs()
+    rafts := makeRafts() // array of []RaftNode
+
+    commit := func(data string) {
+        for retries := 1 ; ; retries++ {
+            ldr := rafts.getLeader(t)
+            ldr.Append(data)
+            err := rafts.checkSingleCommit(t, data)
+            if err == nil {
+                return
+            }
+            log_warning(3, "Committing msg : %v failed", data)
+            if retries>=10 {
+                rafts.shutdownRafts()
+                t.Fatalf("Failed to commit a msg, %v, after 10 retries", data)
+            }
+        }
+    }
+    commit("1")
+
+    // Add 6th node, it catches up with the logs and takes part in commits
+    rafts = rafts.addRaft(6)
+    ldr := rafts.getLeader(t)
+    ldr.AddServer(6)
+    if err := rafts.checkConfigCommit(t, []int{1, 2, 3, 4, 5, 6}); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Membership change failed : %v", err.Error())
+    }
+    commit("2")
+    expect(t, rafts[5].GetLogAt(1).Data, "1", "Log mismatch on added node")
+
+    // Remove the leader, cluster continues with new leader elected among the remaining nodes
+    ldr = rafts.getLeader(t)
+    ldr_id := ldr.GetId()
+    ldr.RemoveServer(ldr_id)
+    members := []int{}
+    for id := 1; id <= 6; id++ {
+        if id != ldr_id {
+            members = append(members, id)
+        }
+    }
+    if err := rafts.checkConfigCommit(t, members); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Membership change failed : %v", err.Error())
+    }
+    expect(t, ldr.IsLeader(), false, "Removed leader did not step down")
+    ldr.Shutdown()
+
+    commit("3")
+    expect(t, fmt.Sprint(rafts.getLeader(t).GetConfig().New), fmt.Sprint(members), "Configuration mismatch on new leader")
+
+    rafts.shutdownRafts()
+}
+
+func TestLearner(t *testing.T) {
+    cleanupLogs()
+    configs := makeConfigs()
+    for _, conf := range configs {
+        conf.Learners = []int{6}
+    }
+    rafts := makeRaftsFrom(configs) // array of []RaftNode
+    rafts = rafts.addRaft(6)
+
+    // Learner receives the logs, without being a voting member
+    ldr := rafts.getLeader(t)
+    ldr.Append("foo")
+    if err := rafts.checkSingleCommit(t, "foo"); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Failed to commit a msg : %v", err.Error())
+    }
+    expect(t, fmt.Sprint(ldr.GetConfig().Learners), "[6]", "Learner missing in configuration")
+    expect(t, rafts[5].GetServerState(), rsm.FOLLOWER, "Learner is not a follower")
+
+    // Caught up learner is promoted to voting member
+    ldr.PromoteLearner(6)
+    if err := rafts.checkConfigCommit(t, []int{1, 2, 3, 4, 5, 6}); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Promotion failed : %v", err.Error())
+    }
+    expect(t, len(rafts.getLeader(t).GetConfig().Learners), 0, "Promoted node is still a learner")
+
+    // Voting members can not be promoted
+    ldr = rafts.getLeader(t)
+    ldr.PromoteLearner(2)
+    timeout := time.After(5 * time.Second)
+    for {
+        select {
+        case commit := <-ldr.CommitChannel:
+            if _, ok := commit.Data.(rsm.PromoteLearnerEvent); !ok {
+                continue
+            }
+            _, ok := commit.Err.(rsm.Error_ConfigChange)
+            expect(t, ok, true, "Voting member promoted")
+            rafts.shutdownRafts()
+            return
+        case <-timeout:
+            rafts.shutdownRafts()
+            t.Fatalf("Promotion of voting member not rejected")
+        }
+    }
+}
+
+
+func TestReadIndex(t *testing.T) {
+    cleanupLogs()
+    rafts := makeRafts() // array of []RaftNode
+
+    ldr := rafts.getLeader(t)
+    ldr.Append("foo")
+    if err := rafts.checkSingleCommit(t, "foo"); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Failed to commit a msg : %v", err.Error())
+    }
+
+    // Leader confirms its leadership, read index covers the committed log
+    index, err := ldr.ReadIndex(5*time.Second)
+    if err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Read index failed on leader : %v", err.Error())
+    }
+    expect(t, index >= 1, true, "Read index does not cover committed log")
+
+    // Followers redirect to the leader
+    follower := rafts[ldr.GetId() % len(rafts)]
+    _, err = follower.ReadIndex(5*time.Second)
+    notLeader, ok := err.(rsm.Error_NotLeader)
+    expect(t, ok, true, "Read index served by follower")
+    expect(t, notLeader.LeaderId, ldr.GetId(), "Follower redirected to wrong leader")
+
+    rafts.shutdownRafts()
+}
+
+func TestLeaseRead(t *testing.T) {
+    cleanupLogs()
+    configs := makeConfigs()
+    for _, conf := range configs {
+        conf.LeaseRead = true
+        conf.LeaseDriftBound = 500
+    }
+    rafts := makeRaftsFrom(configs) // array of []RaftNode
+
+    ldr := rafts.getLeader(t)
+    ldr.Append("foo")
+    if err := rafts.checkSingleCommit(t, "foo"); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Failed to commit a msg : %v", err.Error())
+    }
+
+    // Isolate the leader, it keeps serving reads locally while the lease lasts
+    for _, raft := range rafts {
+        if raft.GetId() != ldr.GetId() {
+            raft.Shutdown()
+        }
+    }
+    index, err := ldr.ReadIndex(100*time.Millisecond)
+    if err != nil {
+        ldr.Shutdown()
+        t.Fatalf("Read index failed within lease : %v", err.Error())
+    }
+    expect(t, index >= 1, true, "Read index does not cover committed log")
+
+    // Once the lease lapses, read needs leadership confirmed by majority
+    time.Sleep(time.Duration(configs[0].ElectionTimeout) * time.Millisecond)
+    _, err = ldr.ReadIndex(500*time.Millisecond)
+    expect(t, err != nil, true, "Read index served after the lease lapsed")
+
+    ldr.Shutdown()
+}
+
+func TestPreVote(t *testing.T) {
+    cleanupLogs()
+    rafts := makeRafts() // array of []RaftNode
+
+    ldr := rafts.getLeader(t)
+    term := ldr.GetCurrentTerm()
+    follower := rafts[ldr.GetId() % len(rafts)]
+
+    // Follower times out while the leader is alive, others deny the pre-vote
+    for i := 0; i < 3; i++ {
+        follower.timer.Reset(0)
+        time.Sleep(500*time.Millisecond)
+    }
+    expect(t, follower.GetCurrentTerm(), term, "Follower changed the term in pre-vote")
+    expect(t, rafts.getLeader(t).GetId(), ldr.GetId(), "Leader deposed by pre-vote")
+    expect(t, ldr.GetCurrentTerm(), term, "Leader term changed by pre-vote")
+
+    // Once the leader is down, pre-vote succeeds and a new leader is elected
+    ldr.Shutdown()
+    newLdr := rafts.getLeader(t)
+    expect(t, newLdr.GetId() != ldr.GetId(), true, "New leader not elected")
+    expect(t, newLdr.GetCurrentTerm() > term, true, "New leader elected without a new term")
+
+    rafts.shutdownRafts()
+}
+
+func TestCheckQuorum(t *testing.T) {
+    cleanupLogs()
+    rafts := makeRafts() // array of []RaftNode
+
+    ldr := rafts.getLeader(t)
+    ldr.Append("foo")
+    if err := rafts.checkSingleCommit(t, "foo"); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Failed to commit a msg : %v", err.Error())
+    }
+
+    // Isolate the leader from majority, pending request must fail once it steps down
+    down := 0
+    for _, raft := range rafts {
+        if raft.GetId() != ldr.GetId() && down < 3 {
+            raft.Shutdown()
+            down++
+        }
+    }
+    ldr.Append("bar")
+
+    timeout := time.After(3 * time.Duration(ldr.server_state.ElectionTimeout) * time.Millisecond)
+    select {
+    case commit := <-ldr.CommitChannel:
+        _, ok := commit.Err.(rsm.Error_NotLeader)
+        expect(t, ok, true, "Request did not fail on isolated leader")
+        expect(t, commit.Data, "bar", "Wrong request failed")
+    case <-timeout:
+        rafts.shutdownRafts()
+        t.Fatalf("Request did not fail fast on isolated leader")
+    }
+    expect(t, ldr.GetServerState(), rsm.FOLLOWER, "Isolated leader did not step down")
+
+    rafts.shutdownRafts()
+}
+
+func TestTransferLeadership(t *testing.T) {
+    cleanupLogs()
+    rafts := makeRafts() // array of []RaftNode
+
+    ldr := rafts.getLeader(t)
+    ldr.Append("foo")
+    if err := rafts.checkSingleCommit(t, "foo"); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Failed to commit a msg : %v", err.Error())
+    }
+
+    // Only members can take over
+    _, ok := ldr.TransferLeadership(9).(rsm.Error_Transfer)
+    expect(t, ok, true, "Leadership transferred to a non-member")
+
+    target := rafts[ldr.GetId() % len(rafts)]
+    if err := ldr.TransferLeadership(target.GetId()); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Leadership transfer failed : %v", err.Error())
+    }
+    expect(t, rafts.getLeader(t).GetId(), target.GetId(), "Leadership transferred to wrong node")
+
+    // New leader continues with the logs
+    target.Append("bar")
+    if err := rafts.checkSingleCommit(t, "bar"); err != nil {
+        rafts.shutdownRafts()
+        t.Fatalf("Failed to commit a msg after transfer : %v", err.Error())
+    }
+
+    rafts.shutdownRafts()
+}
+
+
 func TestBasic(t *testing.T) {
     cleanupLogs()
     rafts := makeRafts()        // array of []RaftNode
@@ -6,6 +6,7 @@ import (
     "strconv"
     "os"
     "errors"
+    "fmt"
     "github.com/cs733-iitb/cluster"
     rsm "github.com/avg598/cs733/client_handler/raft_node/raft_state_machine"
     "github.com/avg598/cs733/logging"
@@ -76,12 +77,13 @@ func makeConfigs() []*raft_config.Config {
                                                         {Id: 3, Address: "localhost:7003"},
                                                         {Id: 4, Address: "localhost:7004"},
                                                         {Id: 5, Address: "localhost:7005"},
+                                                        {Id: 6, Address: "localhost:7006"}, // Not a member, joins through AddServer
                                                     },
                                                 },
     }
 
     var configs []*raft_config.Config
-    for i := 1; i <= 5; i++ {
+    for i := 1; i <= len(configBase.ClusterConfig.Peers); i++ {
         config := configBase // Copy config
         //config.Id = i
         config.LogDir = "/tmp/raft/node" + strconv.Itoa(i) + "/"
@@ -94,8 +96,13 @@ func makeConfigs() []*raft_config.Config {
 }
 
 func makeRafts() Rafts {
+    return makeRaftsFrom(makeConfigs())
+}
+
+// Create and start the members of the cluster from given configs
+func makeRaftsFrom(configs []*raft_config.Config) Rafts {
     var rafts Rafts
-    for i, conf := range makeConfigs() {
+    for i, conf := range configs[:configs[0].NumOfNodes] {
         raft := NewRaftNode(i+1, conf)
         err := raft_config.ToConfigFile(conf.LogDir + "config.json", *conf)
         if err != nil {
@@ -108,6 +115,18 @@ func makeRafts() Rafts {
     return rafts
 }
 
+// Create and start a raft node which is not a member of the cluster
+func (rafts Rafts) addRaft(node_id int) Rafts {
+    conf := makeConfigs()[node_id-1]
+    raft := NewRaftNode(node_id, conf)
+    err := raft_config.ToConfigFile(conf.LogDir + "config.json", *conf)
+    if err != nil {
+        log_error(3, "Error in storing config to file : %v", err.Error())
+    }
+    raft.Start()
+    return append(rafts, raft)
+}
+
 func (rafts Rafts) shutdownRafts() {
     log_info(3, "Shutting down all rafts")
     for _, r := range rafts {
@@ -248,3 +267,30 @@ func (rafts Rafts) checkSingleCommit(t *testing.T, data interface{}) error{
     }
     return nil
 }
+
+// Wait until configuration with given members is committed on all up nodes, other commits are skipped
+func (rafts Rafts) checkConfigCommit(t *testing.T, members []int) error {
+    abortCh := time.NewTimer(10 * time.Second)
+
+    for _, node := range rafts {
+        ConfigLoop:
+        for node.IsNodeUp() {
+            select {
+            case <-abortCh.C:
+                return errors.New("Configuration not committed on all nodes after 10 seconds")
+            case ci := <-node.CommitChannel:
+                config, ok := ci.Data.(rsm.ConfigEntry)
+                if ci.Err != nil || !ok || config.Old != nil {
+                    continue
+                }
+                if fmt.Sprint(config.New) != fmt.Sprint(members) {
+                    rafts.shutdownRafts()
+                    t.Fatalf("Got different configuration on %v node: expected %v , received : %v", node.GetId(), members, config.New)
+                }
+                log_info(3, "Configuration %v committed on %v", members, node.GetId())
+                break ConfigLoop
+            }
+        }
+    }
+    return nil
+}
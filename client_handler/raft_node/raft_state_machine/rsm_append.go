@@ -3,6 +3,7 @@ package raft_state_machine
 import (
     "sort"
     "math/rand"
+    "time"
 )
 
 /********************************************************************
@@ -16,28 +17,18 @@ func (state *StateMachine) appendClientRequest(event *[]AppendEvent) (actions []
 
     switch state.myState {
     case LEADER:
-        prevLogIndex := state.GetLastLogIndex()
-        prevLogTerm  := state.GetLastLogTerm()
-
-        logs := []LogEntry{}
+        if state.transferTarget != 0 {
+            // Leadership is being transferred, requests are not accepted so that target can catch up
+            for _, ev := range *event {
+                actions = append(actions, CommitAction{Index: -1, Data: ev.Data, Err: Error_Commit{}})
+            }
+            return actions
+        }
+        data := []interface{}{}
         for _, ev := range *event {
-            log := LogEntry{Index: state.GetLastLogIndex() + 1, Term: state.CurrentTerm, Data: ev.Data}
-            state.PersistentLog.Append(log)
-            logs = append(logs, log)
+            data = append(data, ev.Data)
         }
-
-        appendReq := AppendRequestEvent{
-            FromId:       state.server_id,
-            Term:         state.CurrentTerm,
-            PrevLogIndex: prevLogIndex,
-            PrevLogTerm:  prevLogTerm,
-            Entries:      logs,
-            LeaderCommit: state.commitIndex}
-        // Append to self log
-        state.matchIndex[state.server_id] = state.GetLastLogIndex()    // Update self matchIndex
-
-
-        actions = append(actions, state.broadcast(appendReq)...)
+        actions = append(actions, state.appendToLog(data)...)
     case CANDIDATE:
         fallthrough
     case FOLLOWER:
@@ -56,6 +47,32 @@ func (state *StateMachine) appendClientRequest(event *[]AppendEvent) (actions []
     return actions
 }
 
+//  Appends data to leader's log, returns actions to replicate the logs
+func (state *StateMachine) appendToLog(data []interface{}) (actions []interface{}) {
+    prevLogIndex := state.GetLastLogIndex()
+    prevLogTerm  := state.GetLastLogTerm()
+
+    logs := []LogEntry{}
+    for _, d := range data {
+        log := LogEntry{Index: state.GetLastLogIndex() + 1, Term: state.CurrentTerm, Data: d}
+        state.PersistentLog.Append(log)
+        state.checkConfigEntry(log)
+        logs = append(logs, log)
+    }
+
+    appendReq := AppendRequestEvent{
+        FromId:       state.server_id,
+        Term:         state.CurrentTerm,
+        PrevLogIndex: prevLogIndex,
+        PrevLogTerm:  prevLogTerm,
+        Entries:      logs,
+        LeaderCommit: state.commitIndex}
+    // Append to self log
+    state.matchIndex[state.server_id] = state.GetLastLogIndex()    // Update self matchIndex
+
+    return state.broadcast(appendReq)
+}
+
 
 
 /********************************************************************
@@ -119,21 +136,33 @@ func (state *StateMachine) appendRequest(event AppendRequestEvent) (actions []in
         // Check if the requester is leader
         if state.CurrentTerm == event.Term {
             state.currentLdr = event.FromId     // current leader is the one from whom msg received
+            state.lastLeaderContact = time.Now()
+            state.preVoting = false
         }
 
 
         requestLogsFrom := int64(-1)
+        conflictTerm := 0
         if state.GetLastLogIndex() < event.PrevLogIndex {   // Check if previous entries are missing
             requestLogsFrom = state.GetLastLogIndex()+1     // Request logs from (last log index + 1)
-        } else if state.GetLogAt(event.PrevLogIndex).Term  !=  event.PrevLogTerm { // Last log terms does not match
-            requestLogsFrom = event.PrevLogIndex            // Request logs from PrevLogIndex
+        } else if event.PrevLogIndex >= state.LastIncludedIndex &&    // Compacted logs are committed, so they match
+            state.GetLogAt(event.PrevLogIndex).Term  !=  event.PrevLogTerm { // Last log terms does not match
+            // Whole term of conflicting logs is skipped, instead of one log at a time
+            conflictTerm = state.GetLogAt(event.PrevLogIndex).Term
+            requestLogsFrom = event.PrevLogIndex
+            for requestLogsFrom-1 > state.LastIncludedIndex && state.GetLogAt(requestLogsFrom-1).Term == conflictTerm {
+                requestLogsFrom--
+            }
         }
         if requestLogsFrom != int64(-1) {
             appendResp := AppendRequestRespEvent {          // Negative ack for
                 FromId          : state.server_id,
                 Term            : state.CurrentTerm,
                 Success         : false,
-                LastLogIndex    : requestLogsFrom-1 }       // Request logs from requestLogsFrom
+                LastLogIndex    : requestLogsFrom-1,        // Request logs from requestLogsFrom
+                Seq             : event.Seq,
+                ConflictTerm    : conflictTerm,
+                ConflictIndex   : requestLogsFrom }
             resp := SendAction{ToId: event.FromId, Event: appendResp}
             actions = append(actions, resp)
             return actions
@@ -144,8 +173,9 @@ func (state *StateMachine) appendRequest(event AppendRequestEvent) (actions []in
 
         // remove logs from logsToAppend which are present in our logs
         for len(logsToAppend)       >   0 &&                                        // logs to append is non empty list
+        (logsToAppend[0].Index  <=  state.LastIncludedIndex ||                  // log is already in the snapshot
         state.GetLastLogIndex() >=  logsToAppend[0].Index &&                    // if there is still intersection between our logs and logs to append
-        logsToAppend[0].Term    ==  state.GetLogAt(logsToAppend[0].Index).Term {// if term match -> logs match -> we have this log
+        logsToAppend[0].Term    ==  state.GetLogAt(logsToAppend[0].Index).Term) {// if term match -> logs match -> we have this log
             logsToAppend = logsToAppend[1:]                                         // skip matched log
         }
 
@@ -159,11 +189,13 @@ func (state *StateMachine) appendRequest(event AppendRequestEvent) (actions []in
                 action := CommitAction{Index:-1, Data: log.Data, Err: Error_Commit{}}
                 actions = append(actions, action)
             }
+            state.updateConfig()    // Truncated logs might have carried active configuration
         }
 
         // Update log if entries are not present
         for _, log := range logsToAppend {
             state.PersistentLog.Append(log)
+            state.checkConfigEntry(log)
         }
 
         if event.LeaderCommit > state.commitIndex {
@@ -190,21 +222,42 @@ func (state *StateMachine) appendRequest(event AppendRequestEvent) (actions []in
 
     }
 
-    // If the append request is heartbeat then ignore responding to it if we are up-to-date with leader
-    // We are updating matchIndex and nextIndex on positive appendRequestResponse, so consume heartbeats
-    if len(event.Entries) != 0 {
-        appendResp := AppendRequestRespEvent{
-            FromId      : state.server_id,
-            Term        : state.CurrentTerm,
-            Success     : true,
-            LastLogIndex: state.GetLastLogIndex() }
-        resp := SendAction{ToId: event.FromId, Event: appendResp}
-        actions = append(actions, resp)
-    }
+    // Respond to heartbeats as well, leader counts the responses to check it is still in contact with majority
+    appendResp := AppendRequestRespEvent{
+        FromId      : state.server_id,
+        Term        : state.CurrentTerm,
+        Success     : true,
+        LastLogIndex: event.PrevLogIndex + int64(len(event.Entries)),    // Logs up to this index match with leader
+        Seq         : event.Seq }
+    resp := SendAction{ToId: event.FromId, Event: appendResp}
+    actions = append(actions, resp)
     return actions
 }
 
 
+//  Returns index from which logs are to be sent to the follower, on negative ack.
+//  If leader has logs of the conflicting term, follower's logs match up to the last of them,
+//  else all the logs of conflicting term are skipped
+func (state *StateMachine) conflictNextIndex(event AppendRequestRespEvent) int64 {
+    if event.ConflictTerm == 0 {
+        return event.LastLogIndex + 1
+    }
+
+    // Terms are non-decreasing in the log, so search back only up to the logs of older term
+    index := state.nextIndex[event.FromId] - 1
+    if index > state.GetLastLogIndex() {
+        index = state.GetLastLogIndex()
+    }
+    for ; index > state.LastIncludedIndex; index-- {
+        term := state.GetLogAt(index).Term
+        if term == event.ConflictTerm {
+            return index + 1
+        } else if term < event.ConflictTerm {
+            break
+        }
+    }
+    return event.ConflictIndex
+}
 
 type int64Slice []int64
 func (array int64Slice) Len() int {
@@ -214,9 +267,7 @@ func (array int64Slice) Less(i int, j int) bool {
     return array[i] < array[j]
 }
 func (array int64Slice) Swap(i int, j int) {
-    tmp := array[i]
-    array[j] = array[i]
-    array[i] = tmp
+    array[i], array[j] = array[j], array[i]
 }
 /********************************************************************
  *                                                                  *
@@ -253,13 +304,23 @@ func (state *StateMachine) appendRequestResponse(event AppendRequestRespEvent) (
 
     switch state.myState {
     case LEADER:
+        if _, ok := state.nextIndex[event.FromId]; !ok {
+            return actions      // Not a member of active configuration
+        }
+        if event.Term == state.CurrentTerm {
+            state.lastHeard[event.FromId] = time.Now()
+            if state.ackedSeq[event.FromId] < event.Seq {
+                state.ackedSeq[event.FromId] = event.Seq
+            }
+        }
+
         if !event.Success {
             // there are holes in follower's log
 
             // Do not upgrade nextIndex if last log index is greater than nextIndex for that node
             // since, this might be delayed response
-            if state.nextIndex[event.FromId] > event.LastLogIndex {
-                state.nextIndex[event.FromId] = event.LastLogIndex + 1
+            if nextIndex := state.conflictNextIndex(event); state.nextIndex[event.FromId] > nextIndex {
+                state.nextIndex[event.FromId] = nextIndex
             }
 
             /*
@@ -287,18 +348,25 @@ func (state *StateMachine) appendRequestResponse(event AppendRequestRespEvent) (
             state.nextIndex[event.FromId] = event.LastLogIndex + 1
 
             // lets sort
-            sorted := int64Slice(append([]int64{}, state.matchIndex[1:]...))
+            sorted := int64Slice{}
+            for _, index := range state.matchIndex {
+                sorted = append(sorted, index)
+            }
             sort.Sort(sorted)               // sort in ascending order
 
             // If there exists an N such that N > commitIndex, a majority
-            // of matchIndex[i] ≥ N, and log[N].term == currentTerm:
+            // of matchIndex[i] ≥ N in active configuration, and log[N].term == currentTerm:
             // set commitIndex = N
             //state.log_info(3, "Sorted match indices : %v", sorted)
-            for i := state.numberOfNodes / 2; i >= 0; i-- {
-                if sorted[i] > state.commitIndex && state.GetLogAt(sorted[i]).Term == state.CurrentTerm {
+            for i := len(sorted) - 1; i >= 0 && sorted[i] > state.commitIndex; i-- {
+                N := sorted[i]
+                replicated := state.isQuorum(func(id int) bool {
+                    return state.matchIndex[id] >= N
+                })
+                if replicated && state.GetLogAt(N).Term == state.CurrentTerm {
                     // Commit all not committed eligible entries
-                    state.log_info(3, "Commiting from index %v to %v", state.commitIndex + 1, sorted[i])
-                    for k := state.commitIndex + 1; k <= sorted[i]; k++ {
+                    state.log_info(3, "Commiting from index %v to %v", state.commitIndex + 1, N)
+                    for k := state.commitIndex + 1; k <= N; k++ {
                         action := CommitAction{
                             Index   : k,
                             Data    : state.GetLogAt(k).Data,
@@ -307,10 +375,16 @@ func (state *StateMachine) appendRequestResponse(event AppendRequestRespEvent) (
                     }
 
                     //server.commitIndex = sorted[i]
-                    state.commitIndex = sorted[i]
+                    state.commitIndex = N
                     break
                 }
             }
+
+            // Configuration change proceeds as its entries are committed
+            actions = append(actions, state.advanceConfig()...)
+            if state.myState != LEADER {
+                return actions
+            }
         }
 
         // Don't send next batch of logs from nextIndex when reply is true,
@@ -319,23 +393,14 @@ func (state *StateMachine) appendRequestResponse(event AppendRequestRespEvent) (
         // heart beat from leader with latest log index, if follower log is out-dated.
 
         // Now send next batch of logs from nextIndex onwards
-        if state.nextIndex[event.FromId] > state.PersistentLog.GetLastIndex()+1 {
-            state.log_error(3, "Next index of any node will never be grater than (last log index + 1) of the leader")
-        } else if state.nextIndex[event.FromId] <= state.PersistentLog.GetLastIndex() {
-            // Resend next batch of logs from the nextIndex to the end
-            prevLog := state.GetLogAt(state.nextIndex[event.FromId] - 1)
-            startIndex := state.nextIndex[event.FromId]
-            logs := state.getLogsFrom(startIndex)   // copy server.log from startIndex to the end to "logs"
-            event1 := AppendRequestEvent{
-                FromId:       state.server_id,
-                Term:         state.CurrentTerm,
-                PrevLogIndex: prevLog.Index,
-                PrevLogTerm:  prevLog.Term,
-                Entries:      *logs,
-                LeaderCommit: state.commitIndex}
-            action := SendAction{ToId: event.FromId, Event: event1}
-            actions = append(actions, action)
-        }
+        actions = append(actions, state.replicateTo(event.FromId)...)
+
+        // Serve reads for which leadership is confirmed and commit index is known
+        state.renewLease()
+        actions = append(actions, state.confirmReads()...)
+
+        // Transfer target might have caught up with the leader
+        actions = append(actions, state.checkTransfer()...)
 
         // continue flow to next case for server.currentTerm > event.term
         fallthrough
@@ -349,3 +414,35 @@ func (state *StateMachine) appendRequestResponse(event AppendRequestRespEvent) (
 
 
 
+
+//  Returns action to send next batch of logs from nextIndex onwards to the node,
+//  snapshot is sent instead if the logs are compacted
+func (state *StateMachine) replicateTo(id int) (actions []interface{}) {
+    actions = []interface{}{}
+
+    if state.nextIndex[id] > state.GetLastLogIndex()+1 {
+        state.log_error(3, "Next index of any node will never be grater than (last log index + 1) of the leader")
+    } else if state.nextIndex[id] <= state.LastIncludedIndex {
+        // Logs required by the node are compacted, send snapshot if not already sending
+        if _, installing := state.snapshotOffset[id]; !installing {
+            state.log_info(3, "Logs from %v required by %v are compacted, sending snapshot", state.nextIndex[id], id)
+            state.snapshotOffset[id] = 0
+            actions = append(actions, SendAction{ToId: id, Event: state.getSnapshotChunk(0)})
+        }
+    } else if state.nextIndex[id] <= state.GetLastLogIndex() {
+        // Resend next batch of logs from the nextIndex to the end
+        prevLog := state.GetLogAt(state.nextIndex[id] - 1)
+        startIndex := state.nextIndex[id]
+        logs := state.getLogsFrom(startIndex)   // copy server.log from startIndex to the end to "logs"
+        event1 := AppendRequestEvent{
+            FromId:       state.server_id,
+            Term:         state.CurrentTerm,
+            PrevLogIndex: prevLog.Index,
+            PrevLogTerm:  prevLog.Term,
+            Entries:      *logs,
+            LeaderCommit: state.commitIndex}
+        action := SendAction{ToId: id, Event: event1}
+        actions = append(actions, action)
+    }
+    return actions
+}
@@ -0,0 +1,109 @@
+package raft_state_machine
+
+import (
+    "os"
+    "testing"
+    "github.com/avg598/cs733/raft_config"
+)
+
+const testLogDir = "/tmp/raft_rsm/"
+
+// Create state machine of the node with logs of given terms, log at index i has terms[i-1]
+func makeState(id int, terms []int) *StateMachine {
+    config := &raft_config.Config{
+        LogDir           : testLogDir,
+        ElectionTimeout  : 2000,
+        HeartbeatTimeout : 250,
+        NumOfNodes       : 2}
+    state := New(id, config)
+    for i, term := range terms {
+        state.PersistentLog.Append(LogEntry{Index: int64(i+1), Term: term, Data: i+1})
+        state.CurrentTerm = term
+    }
+    return state
+}
+
+// Returns terms of the logs of given lengths, e.g. logTerms(1, 3, 2, 2) is [1 1 1 2 2]
+func logTerms(termLengths ...int) []int {
+    terms := []int{}
+    for i := 0; i+1 < len(termLengths); i += 2 {
+        for j := 0; j < termLengths[i+1]; j++ {
+            terms = append(terms, termLengths[i])
+        }
+    }
+    return terms
+}
+
+// Deliver messages between leader and follower until they stop, returns number of append requests delivered
+func exchange(leader *StateMachine, follower *StateMachine, actions []interface{}) int {
+    rounds := 0
+    for len(actions) > 0 && rounds < 1000 {
+        action := actions[0]
+        actions = actions[1:]
+
+        send, ok := action.(SendAction)
+        if !ok {
+            continue
+        }
+        if _, ok := send.Event.(AppendRequestEvent); ok {
+            rounds++
+        }
+        switch send.ToId {
+        case leader.server_id:
+            actions = append(actions, leader.ProcessEvent(send.Event)...)
+        case follower.server_id:
+            actions = append(actions, follower.ProcessEvent(send.Event)...)
+        }
+    }
+    return rounds
+}
+
+// Check that follower's logs match leader's logs
+func expectLogsMatch(t *testing.T, leader *StateMachine, follower *StateMachine) {
+    if leader.GetLastLogIndex() != follower.GetLastLogIndex() {
+        t.Fatalf("Last log index mismatch, leader : %v, follower : %v", leader.GetLastLogIndex(), follower.GetLastLogIndex())
+    }
+    for i := int64(1); i <= leader.GetLastLogIndex(); i++ {
+        if leader.GetLogAt(i).Term != follower.GetLogAt(i).Term {
+            t.Fatalf("Log term mismatch at %v, leader : %v, follower : %v", i, leader.GetLogAt(i).Term, follower.GetLogAt(i).Term)
+        }
+    }
+}
+
+func testBacktracking(t *testing.T, leaderTerms []int, followerTerms []int, maxRounds int) {
+    os.RemoveAll(testLogDir)
+    defer os.RemoveAll(testLogDir)
+
+    leader := makeState(1, leaderTerms)
+    follower := makeState(2, followerTerms)
+    leader.CurrentTerm++
+    leader.initialiseLeader()
+
+    actions := leader.ProcessEvent(TimeoutEvent{})  // Heartbeat
+    rounds := exchange(leader, follower, actions)
+
+    expectLogsMatch(t, leader, follower)
+    if rounds > maxRounds {
+        t.Fatalf("Logs converged in %v rounds, expected at most %v", rounds, maxRounds)
+    }
+}
+
+// Follower has a long run of logs from a term the leader does not have
+func TestAppend_ConflictTermMissing(t *testing.T) {
+    testBacktracking(t, logTerms(1, 10, 3, 20), logTerms(1, 10, 2, 20), 2)
+}
+
+// Leader has some logs of the conflicting term, follower's logs match up to the last of them
+func TestAppend_ConflictTermPresent(t *testing.T) {
+    testBacktracking(t, logTerms(1, 10, 2, 5, 3, 15), logTerms(1, 10, 2, 20), 2)
+}
+
+// Follower's log is shorter than leader's log
+func TestAppend_MissingLogs(t *testing.T) {
+    testBacktracking(t, logTerms(1, 10, 2, 20), logTerms(1, 10), 2)
+}
+
+// Several conflicting terms are skipped one term per round
+func TestAppend_ConflictTerms(t *testing.T) {
+    testBacktracking(t, logTerms(1, 10, 5, 20), logTerms(1, 10, 2, 5, 3, 5, 4, 10), 4)
+}
@@ -2,8 +2,124 @@ package raft_state_machine
 
 import (
     "math/rand"
+    "time"
 )
 
+//  Returns true if this node believes current leader is alive, used to ignore disruptive vote requests
+func (state *StateMachine) isLeaderAlive() bool {
+    switch state.myState {
+    case LEADER:
+        return !state.leaseRead || time.Now().Before(state.leaseExpiry)
+    case FOLLOWER:
+        return time.Since(state.lastLeaderContact) < time.Duration(state.ElectionTimeout) * time.Millisecond
+    }
+    return false
+}
+
+//  Returns true if logs ending with given index and term are at least as up-to-date as this node's logs
+func (state *StateMachine) isUpToDate(lastLogIndex int64, lastLogTerm int) bool {
+    return lastLogTerm > state.GetLastLogTerm() || lastLogTerm == state.GetLastLogTerm() && lastLogIndex >= state.GetLastLogIndex()
+}
+
+/********************************************************************
+ *                                                                  *
+ *                          Pre-vote                                *
+ *                                                                  *
+ ********************************************************************/
+func (state *StateMachine) startPreVote() (actions []interface{}) {
+
+    actions = make([]interface{}, 0)
+
+    state.myState = FOLLOWER
+    state.preVoting = true
+    state.preVotes = map[int]bool{state.server_id: true}
+    actions = append(actions, AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)})
+
+    preVoteReq := PreVoteEvent{
+        FromId:       state.server_id,
+        Term:         state.CurrentTerm + 1,
+        LastLogIndex: state.GetLastLogIndex(),
+        LastLogTerm:  state.GetLastLogTerm()}
+    actions = append(actions, state.broadcast(preVoteReq)...)
+    return actions
+}
+
+func (state *StateMachine) preVoteRequest(event PreVoteEvent) (actions []interface{}) {
+
+    actions = make([]interface{}, 0)
+
+    // Grant if this node would vote in event.Term, and it has not heard from a leader recently
+    granted := event.Term > state.CurrentTerm &&
+        !state.isLeaderAlive() &&
+        state.config.contains(event.FromId) &&
+        state.isUpToDate(event.LastLogIndex, event.LastLogTerm)
+
+    voteResp := PreVoteRespEvent{FromId: state.server_id, Term: state.CurrentTerm, VoteGranted: granted}
+    if granted {
+        voteResp.Term = event.Term
+    }
+    actions = append(actions, SendAction{ToId: event.FromId, Event: voteResp})
+    return actions
+}
+
+func (state *StateMachine) preVoteResponse(event PreVoteRespEvent) (actions []interface{}) {
+
+    actions = make([]interface{}, 0)
+
+    if !event.VoteGranted && state.CurrentTerm < event.Term {
+        // This server term is not so up-to-date, so update
+        state.myState = FOLLOWER
+        state.CurrentTerm = event.Term
+        state.VotedFor = -1
+        state.preVoting = false
+
+        actions = append(actions, AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)})
+        actions = append(actions, state.GetStateStoreAction())
+        return actions
+    } else if !state.preVoting || event.Term != state.CurrentTerm + 1 {
+        // Response of an old pre-vote round, drop it
+        return actions
+    }
+
+    state.preVotes[event.FromId] = event.VoteGranted
+    granted := state.isQuorum(func(id int) bool {
+        return state.preVotes[id]
+    })
+    if granted {
+        state.log_info(3, "Pre-vote granted by majority, starting election for term %v", event.Term)
+        actions = append(actions, state.startElection(false)...)
+    }
+    return actions
+}
+
+/********************************************************************
+ *                                                                  *
+ *                          Start election                          *
+ *                                                                  *
+ ********************************************************************/
+func (state *StateMachine) startElection(transfer bool) (actions []interface{}) {
+
+    actions = make([]interface{}, 0)
+
+    state.preVoting = false
+    state.myState = CANDIDATE
+    state.CurrentTerm = state.CurrentTerm + 1
+    state.VotedFor = state.server_id
+    actions = append(actions, AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)})
+    state.receivedVote[state.server_id] = state.CurrentTerm // voting to self
+
+    voteReq := RequestVoteEvent{
+        FromId:       state.server_id,
+        Term:         state.CurrentTerm,
+        LastLogIndex: state.GetLastLogIndex(),
+        LastLogTerm:  state.GetLastLogTerm(),
+        Transfer:     transfer}
+    voteReqActions := state.broadcast(voteReq) // broadcast request vote event
+    actions = append(actions, voteReqActions...)
+    actions = append(actions, state.GetStateStoreAction())
+    return actions
+}
+
 /********************************************************************
  *                                                                  *
  *                          Vote Request                            *
@@ -29,6 +145,19 @@ func (state *StateMachine) voteRequest(event RequestVoteEvent) (actions []interf
         resp := SendAction{ToId: event.FromId, Event: voteResp}
         actions = append(actions, resp)
         return actions
+    } else if !event.Transfer && state.leaseRead && state.isLeaderAlive() {
+        // Leader lease relies on no new leader being elected while current leader is in contact with majority
+        voteResp := RequestVoteRespEvent{FromId: state.server_id, Term: state.CurrentTerm, VoteGranted: false}
+        resp := SendAction{ToId: event.FromId, Event: voteResp}
+        actions = append(actions, resp)
+        return actions
+    } else if !state.config.contains(event.FromId) {
+        // Candidate is not a member of active configuration, it might have been removed,
+        // so do not let it disrupt the cluster
+        voteResp := RequestVoteRespEvent{FromId: state.server_id, Term: state.CurrentTerm, VoteGranted: false}
+        resp := SendAction{ToId: event.FromId, Event: voteResp}
+        actions = append(actions, resp)
+        return actions
     } else if event.Term > state.CurrentTerm {
         // Request from more up-to-date node, so lets update our state
         state.CurrentTerm = event.Term
@@ -41,7 +170,7 @@ func (state *StateMachine) voteRequest(event RequestVoteEvent) (actions []interf
     // If not voted for this term
     if state.VotedFor == -1 {
         // votedFor will be -1 ONLY for follower state, in case of leader/candidate it will be set to self id
-        if event.LastLogTerm > state.GetLastLogTerm() || event.LastLogTerm == state.GetLastLogTerm() && event.LastLogIndex >= state.GetLastLogIndex() {
+        if state.isUpToDate(event.LastLogIndex, event.LastLogTerm) {
             state.VotedFor = event.FromId
             state.CurrentTerm = event.Term
             state_changed_flag = true
@@ -111,7 +240,7 @@ func (state *StateMachine) voteRequestResponse(event RequestVoteRespEvent) (acti
 
     case CANDIDATE:
         // Refer comments @ receivedVote declaration
-        // If vote received from a node, we are storing the term in receivedVote array for which the vote has received.
+        // If vote received from a node, we are storing the term in receivedVote map for which the vote has received.
         // This way we don't need to reinitialise the voted for array every time new election starts
         vote := state.receivedVote[event.FromId]
         if vote < 0 {
@@ -124,22 +253,19 @@ func (state *StateMachine) voteRequestResponse(event RequestVoteRespEvent) (acti
             } else {
                 state.receivedVote[event.FromId] = -event.Term
             }
-            count := 0
-            ncount := 0
-            for _, vote := range state.receivedVote {
-                if vote == event.Term {
-                    count++
-                } else if vote == -event.Term {
-                    ncount++
-                }
-            }
-            //fmt.Printf("eventTerm:%v\n COUNTING : %v : %v : %v\n",event.term, count,ncount, server.receivedVote)
+            // Votes are counted in active configuration, separately for old and new in joint configuration
+            granted := state.isQuorum(func(id int) bool {
+                return state.receivedVote[id] == event.Term
+            })
+            rejected := !state.isQuorum(func(id int) bool {
+                return state.receivedVote[id] != -event.Term
+            })
 
-            if ncount > state.numberOfNodes/2 {
+            if rejected {
                 // majority of -ve votes, so change to follower
                 state.myState = FOLLOWER
                 return actions
-            } else if count > state.numberOfNodes/2 {
+            } else if granted {
                 // become leader
 
                 state.log_info(3, "Leader has been elected : %v", state.server_id)
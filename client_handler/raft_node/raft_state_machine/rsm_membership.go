@@ -0,0 +1,263 @@
+package raft_state_machine
+
+import (
+    "fmt"
+    "math/rand"
+    "sort"
+)
+
+/*
+ *  Configuration of the cluster, replicated as data of a log entry.
+ *  Old is set only for joint configuration C_old,new, in which decisions need majority of both Old and New.
+ *  Learners receive the logs, but neither vote nor count towards majority.
+ *  Configuration takes effect on a server as soon as its entry is appended to the log, committed or not.
+ */
+type ConfigEntry struct {
+    Old      []int  // Members of old configuration, nil if configuration is not joint
+    New      []int  // Members of new configuration
+    Learners []int  // Non-voting members
+}
+
+/*
+ *  Input events : client requests to add or remove a server, add a learner or promote it to voting member.
+ *  Removing a learner does not need joint configuration, neither does adding it.
+ */
+type AddServerEvent struct {
+    Id int
+}
+type RemoveServerEvent struct {
+    Id int
+}
+type AddLearnerEvent struct {
+    Id int
+}
+type PromoteLearnerEvent struct {
+    Id int
+}
+
+type Error_ConfigChange struct {
+    Reason string
+}
+func (err Error_ConfigChange) Error() string {
+    return "Unable to change the configuration : " + err.Reason
+}
+
+func (config ConfigEntry) isJoint() bool {
+    return config.Old != nil
+}
+//  Returns true if the node is a voting member
+func (config ConfigEntry) contains(id int) bool {
+    return contains(config.Old, id) || contains(config.New, id)
+}
+//  Returns nodes to which logs are replicated, members of both old and new configuration and learners
+func (config ConfigEntry) peers() []int {
+    peers := append([]int{}, config.New...)
+    for _, id := range append(append([]int{}, config.Old...), config.Learners...) {
+        if !contains(peers, id) {
+            peers = append(peers, id)
+        }
+    }
+    return peers
+}
+func (config ConfigEntry) String() string {
+    str := fmt.Sprintf("%v", config.New)
+    if config.isJoint() {
+        str = fmt.Sprintf("%v,%v", config.Old, config.New)
+    }
+    if len(config.Learners) > 0 {
+        str += fmt.Sprintf(" learners:%v", config.Learners)
+    }
+    return str
+}
+
+func contains(ids []int, id int) bool {
+    for _, i := range ids {
+        if i == id {
+            return true
+        }
+    }
+    return false
+}
+
+// Returns copy of ids without id
+func remove(ids []int, id int) []int {
+    rest := []int{}
+    for _, i := range ids {
+        if i != id {
+            rest = append(rest, i)
+        }
+    }
+    return rest
+}
+
+// Returns true if more than half of the ids satisfy the condition
+func majority(ids []int, has func(id int) bool) bool {
+    count := 0
+    for _, id := range ids {
+        if has(id) {
+            count++
+        }
+    }
+    return count > len(ids)/2
+}
+
+// Returns true if the nodes satisfying the condition form a quorum in the active configuration,
+// joint configuration requires separate majorities of old and new configurations
+func (state *StateMachine) isQuorum(has func(id int) bool) bool {
+    if state.config.isJoint() && !majority(state.config.Old, has) {
+        return false
+    }
+    return majority(state.config.New, has)
+}
+
+// Returns active configuration
+func (state *StateMachine) GetConfig() ConfigEntry {
+    return state.config
+}
+
+//  Returns latest configuration in the logs up to given index, and index of its entry
+func (state *StateMachine) configAt(index int64) (ConfigEntry, int64) {
+    for i := index; i > state.LastIncludedIndex; i-- {
+        if config, ok := state.GetLogAt(i).Data.(ConfigEntry); ok {
+            return config, i
+        }
+    }
+    return state.baseConfig, state.LastIncludedIndex
+}
+
+//  Recompute active configuration from the logs, used when logs are truncated or replaced
+func (state *StateMachine) updateConfig() {
+    state.config, state.configIndex = state.configAt(state.GetLastLogIndex())
+    if state.myState == LEADER {
+        state.trackPeers()
+    }
+}
+
+//  Activate the configuration if the log carries one
+func (state *StateMachine) checkConfigEntry(log LogEntry) {
+    if config, ok := log.Data.(ConfigEntry); ok {
+        state.log_info(4, "Configuration %v at index %v is active", config, log.Index)
+        state.config = config
+        state.configIndex = log.Index
+        if state.myState == LEADER {
+            state.trackPeers()
+        }
+    }
+}
+
+//  Leader keeps replication state only for the members and learners of active configuration
+func (state *StateMachine) trackPeers() {
+    members := state.config.peers()
+    for _, id := range members {
+        if _, ok := state.nextIndex[id]; !ok {
+            state.nextIndex[id] = state.GetLastLogIndex() + 1
+            state.matchIndex[id] = 0
+        }
+    }
+    for id := range state.nextIndex {
+        if !contains(members, id) && id != state.server_id {
+            delete(state.nextIndex, id)
+            delete(state.matchIndex, id)
+            delete(state.snapshotOffset, id)
+        }
+    }
+}
+
+/********************************************************************
+ *                                                                  *
+ *                      Configuration change                        *
+ *                                                                  *
+ ********************************************************************/
+func (state *StateMachine) changeConfig(event interface{}) (actions []interface{}) {
+    actions = []interface{}{}
+
+    reject := func(err error) []interface{} {
+        return append(actions, CommitAction{Index: -1, Data: event, Err: err})
+    }
+
+    if state.myState != LEADER {
+        return reject(Error_NotLeader{LeaderId: state.GetCurrentLeader()})
+    }
+    // One change at a time, previous change must be completed and committed
+    if state.config.isJoint() || state.configIndex > state.commitIndex {
+        return reject(Error_ConfigChange{Reason: "configuration change is in progress"})
+    } else if state.transferTarget != 0 {
+        return reject(Error_ConfigChange{Reason: "leadership transfer is in progress"})
+    }
+
+    members := append([]int{}, state.config.New...)
+    learners := append([]int{}, state.config.Learners...)
+    switch event.(type) {
+    case AddServerEvent:
+        id := event.(AddServerEvent).Id
+        if contains(members, id) || contains(learners, id) {
+            return reject(Error_ConfigChange{Reason: fmt.Sprintf("server %v is already a member", id)})
+        }
+        members = append(members, id)
+    case AddLearnerEvent:
+        id := event.(AddLearnerEvent).Id
+        if contains(members, id) || contains(learners, id) {
+            return reject(Error_ConfigChange{Reason: fmt.Sprintf("server %v is already a member", id)})
+        }
+        learners = append(learners, id)
+    case PromoteLearnerEvent:
+        id := event.(PromoteLearnerEvent).Id
+        if !contains(learners, id) {
+            return reject(Error_ConfigChange{Reason: fmt.Sprintf("server %v is not a learner", id)})
+        } else if state.matchIndex[id] < state.commitIndex {
+            // Learner lagging behind would stall the commits once it counts towards majority
+            return reject(Error_ConfigChange{Reason: fmt.Sprintf("learner %v has not caught up", id)})
+        }
+        learners = remove(learners, id)
+        members = append(members, id)
+    case RemoveServerEvent:
+        id := event.(RemoveServerEvent).Id
+        if contains(learners, id) {
+            learners = remove(learners, id)
+        } else if !contains(members, id) {
+            return reject(Error_ConfigChange{Reason: fmt.Sprintf("server %v is not a member", id)})
+        } else if len(members) == 1 {
+            return reject(Error_ConfigChange{Reason: "last member can not be removed"})
+        } else {
+            members = remove(members, id)
+        }
+    }
+    sort.Ints(members)
+    sort.Ints(learners)
+
+    config := ConfigEntry{New: members, Learners: learners}
+    if fmt.Sprint(members) != fmt.Sprint(state.config.New) {
+        // Voting members change, so move to joint configuration C_old,new first
+        config.Old = state.config.New
+    }
+    state.log_info(3, "Changing configuration from %v to %v", state.config, config)
+    return state.appendToLog([]interface{}{config})
+}
+
+//  Leader moves the configuration forward once its entry is committed
+func (state *StateMachine) advanceConfig() (actions []interface{}) {
+    actions = []interface{}{}
+
+    if state.myState != LEADER || state.configIndex > state.commitIndex {
+        return actions
+    }
+
+    if state.config.isJoint() {
+        // C_old,new is committed, now C_new can be replicated
+        return state.appendToLog([]interface{}{ConfigEntry{New: state.config.New, Learners: state.config.Learners}})
+    } else if !state.config.contains(state.server_id) {
+        // Leader is not part of committed C_new, let the followers know commit index and step down
+        state.log_info(3, "Removed from the cluster, stepping down")
+        heartbeatEvent := AppendRequestEvent{
+            FromId:       state.server_id,
+            Term:         state.CurrentTerm,
+            PrevLogIndex: state.GetLastLogIndex(),
+            PrevLogTerm:  state.GetLastLogTerm(),
+            Entries:      []LogEntry{},
+            LeaderCommit: state.commitIndex}
+        actions = append(actions, state.broadcast(heartbeatEvent)...)
+        state.myState = FOLLOWER
+        actions = append(actions, AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)})
+    }
+    return actions
+}
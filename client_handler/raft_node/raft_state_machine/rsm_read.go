@@ -0,0 +1,153 @@
+package raft_state_machine
+
+import (
+    "time"
+)
+
+/*
+ *  Input event : client requests index up to which logs must be applied to serve a linearizable read.
+ *  Data is returned back with ReadIndexAction, it is not interpreted by the state machine.
+ */
+type ReadIndexEvent struct {
+    Data interface{}
+}
+
+/*
+ *  Output action : read can be served once client has applied logs up to Index, Index is valid only if Err == nil
+ */
+type ReadIndexAction struct {
+    Index int64
+    Data  interface{}
+    Err   error
+}
+
+/*
+ *  Log appended by a new leader to commit an entry of its term, it has no effect on client's state machine
+ */
+type NoOp struct {}
+
+/*
+ *  Read waiting for leadership to be confirmed by heartbeat round Seq
+ */
+type pendingRead struct {
+    Seq  int64
+    Data interface{}
+}
+
+/********************************************************************
+ *                                                                  *
+ *                          Read Index                              *
+ *                                                                  *
+ ********************************************************************/
+func (state *StateMachine) readIndex(event ReadIndexEvent) (actions []interface{}) {
+    actions = []interface{}{}
+
+    if state.myState != LEADER {
+        action := ReadIndexAction{
+            Index   : -1,
+            Data    : event.Data,
+            Err     : Error_NotLeader{LeaderId: state.GetCurrentLeader()} }
+        return append(actions, action)
+    }
+
+    // Leader knows the latest commit index only after an entry of its term is committed
+    if state.GetLastLogTerm() != state.CurrentTerm {
+        actions = append(actions, state.appendToLog([]interface{}{NoOp{}})...)
+    }
+
+    // Within the lease no other leader can be elected, so the commit index is latest.
+    // Unless leadership is being transferred, votes for the target ignore the lease
+    if state.leaseRead && state.transferTarget == 0 && time.Now().Before(state.leaseExpiry) &&
+        state.GetLogAt(state.commitIndex).Term == state.CurrentTerm {
+        return append(actions, ReadIndexAction{Index: state.commitIndex, Data: event.Data, Err: nil})
+    }
+
+    // Confirm leadership by a new heartbeat round, this read is served once majority acknowledges it
+    seq := state.newHeartbeatRound()
+    state.pendingReads = append(state.pendingReads, pendingRead{Seq: seq, Data: event.Data})
+    heartbeatEvent := AppendRequestEvent{
+        FromId:       state.server_id,
+        Term:         state.CurrentTerm,
+        PrevLogIndex: state.GetLastLogIndex(),
+        PrevLogTerm:  state.GetLastLogTerm(),
+        Entries:      []LogEntry{},
+        LeaderCommit: state.commitIndex,
+        Seq:          seq}
+    actions = append(actions, state.broadcast(heartbeatEvent)...)
+
+    return append(actions, state.confirmReads()...)
+}
+
+//  Returns read index actions for the pending reads for which leadership is confirmed
+func (state *StateMachine) confirmReads() (actions []interface{}) {
+    actions = []interface{}{}
+
+    // Commit index is latest only if entry of current term is committed
+    if len(state.pendingReads) == 0 || state.GetLogAt(state.commitIndex).Term != state.CurrentTerm {
+        return actions
+    }
+
+    for len(state.pendingReads) > 0 {
+        read := state.pendingReads[0]
+        confirmed := state.isQuorum(func(id int) bool {
+            return state.ackedSeq[id] >= read.Seq
+        })
+        if !confirmed {
+            break
+        }
+
+        // Commit index now is at least the one at the time of the request,
+        // and all the logs up to it are committed, so it is safe to read at it
+        state.pendingReads = state.pendingReads[1:]
+        actions = append(actions, ReadIndexAction{Index: state.commitIndex, Data: read.Data, Err: nil})
+    }
+    return actions
+}
+
+//  Starts new heartbeat round, acknowledgements of which confirm the leadership
+func (state *StateMachine) newHeartbeatRound() int64 {
+    state.heartbeatSeq++
+    state.seqSentAt[state.heartbeatSeq] = time.Now()
+    state.ackedSeq[state.server_id] = state.heartbeatSeq
+    return state.heartbeatSeq
+}
+
+//  Extends the lease up to latest heartbeat round acknowledged by majority.
+//  Followers do not vote for ElectionTimeout after hearing from the leader, so no other leader
+//  can be elected within leaseDuration from the start of the round
+func (state *StateMachine) renewLease() {
+    confirmed := int64(0)
+    for _, seq := range state.ackedSeq {
+        seq := seq
+        if seq > confirmed && state.isQuorum(func(id int) bool { return state.ackedSeq[id] >= seq }) {
+            confirmed = seq
+        }
+    }
+
+    for seq, sentAt := range state.seqSentAt {
+        if seq == confirmed {
+            state.leaseExpiry = sentAt.Add(state.leaseDuration)
+        }
+        if seq <= confirmed {
+            delete(state.seqSentAt, seq)
+        }
+    }
+}
+
+//  Fails pending reads when leadership is lost
+func (state *StateMachine) abortReads() (actions []interface{}) {
+    actions = []interface{}{}
+    if state.myState == LEADER {
+        return actions
+    }
+
+    for _, read := range state.pendingReads {
+        action := ReadIndexAction{
+            Index   : -1,
+            Data    : read.Data,
+            Err     : Error_NotLeader{LeaderId: state.GetCurrentLeader()} }
+        actions = append(actions, action)
+    }
+    state.pendingReads = nil
+    return actions
+}
@@ -0,0 +1,391 @@
+package raft_state_machine
+
+import (
+    "os"
+    "math/rand"
+    "path"
+    "strconv"
+    "encoding/gob"
+    "time"
+)
+
+const SnapshotFile = "snapshot"
+const SNAPSHOT_CHUNKSIZE = 64 * 1024   // Snapshot is sent to followers in chunks of this size
+
+/*
+ *  Snapshot of the client state machine, replaces all the logs up to LastIncludedIndex
+ */
+type Snapshot struct {
+    LastIncludedIndex int64       // Index of the last log applied to Data
+    LastIncludedTerm  int         // Term of the log at LastIncludedIndex
+    Config            ConfigEntry // Configuration of the cluster as of LastIncludedIndex
+    Data              []byte      // Serialised state of the client state machine
+}
+
+/*
+ *  Input event : client has captured its state, applied up to Index, in Data
+ */
+type SnapshotEvent struct {
+    Index int64
+    Data  []byte
+}
+
+/*
+ *  Leader sends its snapshot in chunks to the follower whose required logs are compacted
+ */
+type InstallSnapshotEvent struct {
+    FromId            int
+    Term              int
+    LastIncludedIndex int64
+    LastIncludedTerm  int
+    Config            ConfigEntry
+    Offset            int64     // Offset of this chunk in the snapshot data
+    Data              []byte    // Chunk of the snapshot data
+    Done              bool      // Set for the last chunk
+}
+
+type InstallSnapshotRespEvent struct {
+    FromId            int
+    Term              int
+    LastIncludedIndex int64     // Snapshot for which the chunks are being received
+    Offset            int64     // Number of bytes of the snapshot received so far, i.e. offset of next chunk
+    LastLogIndex      int64     // Set if the node already has the logs of the snapshot, index of its last log
+}
+
+/*
+ *  Output actions
+ */
+// Remove the persistent log which is replaced by compacted one
+type DiscardLogAction struct {
+    Path string
+}
+
+// Stores snapshot to file, the file is replaced only after the snapshot is completely written
+func (snapshot *Snapshot) ToSnapshotFile(snapshotFile string) (err error) {
+    var f *os.File
+    tmpFile := snapshotFile + ".tmp"
+    if f, err = os.Create(tmpFile); err != nil {
+        return err
+    }
+    if err = gob.NewEncoder(f).Encode(*snapshot); err != nil {
+        f.Close()
+        return err
+    }
+    if err = f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    f.Close()
+    return os.Rename(tmpFile, snapshotFile)
+}
+
+// Reads snapshot from file, returns nil snapshot if the file does not exist
+func FromSnapshotFile(snapshotFile string) (snapshot *Snapshot, err error) {
+    var f *os.File
+    if f, err = os.Open(snapshotFile); err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    defer f.Close()
+
+    snapshot = &Snapshot{}
+    if err = gob.NewDecoder(f).Decode(snapshot); err != nil {
+        return nil, err
+    }
+    return snapshot, nil
+}
+
+// Returns persistent log path which starts with the log at given index
+func (state *StateMachine) logPath(index int64) string {
+    return path.Clean(state.logDir + "/log_" + strconv.FormatInt(index, 10) + "/")
+}
+
+// Stores snapshot on persistent store, before the logs it replaces are discarded
+func (state *StateMachine) saveSnapshot(snapshot Snapshot) error {
+    return snapshot.ToSnapshotFile(path.Clean(state.logDir + "/" + SnapshotFile))
+}
+
+// Returns latest snapshot, nil if no snapshot has been taken
+func (state *StateMachine) GetSnapshot() *Snapshot {
+    return state.snapshot
+}
+
+/********************************************************************
+ *                                                                  *
+ *                          Snapshot                                *
+ *                                                                  *
+ ********************************************************************/
+func (state *StateMachine) takeSnapshot(event SnapshotEvent) (actions []interface{}) {
+    actions = []interface{}{}
+
+    if event.Index <= state.LastIncludedIndex || event.Index > state.commitIndex {
+        state.log_warning(3, "Ignoring snapshot at %v, last included index:%v commit index:%v", event.Index, state.LastIncludedIndex, state.commitIndex)
+        return actions
+    }
+
+    config, _ := state.configAt(event.Index)
+    snapshot := Snapshot{
+        LastIncludedIndex   : event.Index,
+        LastIncludedTerm    : state.GetLogAt(event.Index).Term,
+        Config              : config,
+        Data                : event.Data }
+
+    // Snapshot must be on persistent store before the logs it replaces are discarded
+    if err := state.saveSnapshot(snapshot); err != nil {
+        state.log_error(3, "Unable to store snapshot at %v, logs are kept : %v", event.Index, err.Error())
+        return actions
+    }
+    actions = append(actions, state.compactLogs(snapshot, true)...)
+    state.snapshot = &snapshot
+
+    state.log_info(3, "Snapshot taken at index %v, logs compacted", event.Index)
+    return actions
+}
+
+//  Replaces persistent log with a new one, first log of which stands for the snapshot.
+//  Logs after the snapshot are carried over to the new log if keepTail is set.
+//  Returns actions to store the state and discard the old log, in that order.
+func (state *StateMachine) compactLogs(snapshot Snapshot, keepTail bool) []interface{} {
+    index := snapshot.LastIncludedIndex
+    term  := snapshot.LastIncludedTerm
+    newPath := state.logPath(index)
+    oldPath := state.logPath(state.LastIncludedIndex)
+
+    os.RemoveAll(newPath)   // Might be left behind by a crash during last compaction
+    newLog := state.openLog(newPath)
+    newLog.Append(LogEntry{Index: index, Term: term, Data: "Snapshot Entry"})
+    if keepTail {
+        for i := index + 1; i <= state.GetLastLogIndex(); i++ {
+            newLog.Append(*state.GetLogAt(i))
+        }
+    }
+
+    state.PersistentLog.Close()
+    state.PersistentLog     = newLog
+    state.LastIncludedIndex = index
+    state.LastIncludedTerm  = term
+    state.baseConfig        = snapshot.Config
+    state.updateConfig()
+    if state.commitIndex < index {
+        state.commitIndex = index
+    }
+    if state.LastApplied < index {
+        state.LastApplied = index
+    }
+
+    return []interface{}{state.GetStateStoreAction(), DiscardLogAction{Path: oldPath}}
+}
+
+//  Commit actions for the logs which were applied before restart, but are not part of the snapshot
+func (state *StateMachine) ReplayCommitted() (actions []interface{}) {
+    actions = []interface{}{}
+    for i := state.LastIncludedIndex + 1; i <= state.LastApplied && i <= state.GetLastLogIndex(); i++ {
+        actions = append(actions, CommitAction{Index: i, Data: state.GetLogAt(i).Data, Err: nil})
+    }
+    return actions
+}
+
+//  Returns chunk of the snapshot starting at offset to be sent to the node
+func (state *StateMachine) getSnapshotChunk(offset int64) InstallSnapshotEvent {
+    data := state.snapshot.Data
+    end := offset + SNAPSHOT_CHUNKSIZE
+    if end > int64(len(data)) {
+        end = int64(len(data))
+    }
+
+    return InstallSnapshotEvent{
+        FromId              : state.server_id,
+        Term                : state.CurrentTerm,
+        LastIncludedIndex   : state.snapshot.LastIncludedIndex,
+        LastIncludedTerm    : state.snapshot.LastIncludedTerm,
+        Config              : state.snapshot.Config,
+        Offset              : offset,
+        Data                : data[offset:end],
+        Done                : end == int64(len(data)) }
+}
+
+/********************************************************************
+ *                                                                  *
+ *                      Install Snapshot                            *
+ *                                                                  *
+ ********************************************************************/
+func (state *StateMachine) installSnapshot(event InstallSnapshotEvent) (actions []interface{}) {
+    actions = make([]interface{}, 0)
+
+    // Track if persistent state of raft state machine changes
+    state_changed_flag := false
+    // Check and store state on persistent store
+    defer func() {
+        if state_changed_flag {
+            // Prepend StateStore action
+            actions = append(actions, state.GetStateStoreAction())
+        }
+    }()
+
+    respond := func(offset int64) {
+        resp := InstallSnapshotRespEvent{
+            FromId              : state.server_id,
+            Term                : state.CurrentTerm,
+            LastIncludedIndex   : event.LastIncludedIndex,
+            Offset              : offset }
+        actions = append(actions, SendAction{ToId: event.FromId, Event: resp})
+    }
+
+    if state.CurrentTerm > event.Term {
+        // Snapshot is not from latest leader
+        respond(0)
+        return actions
+    }
+
+    // Snapshot from current leader, convert to follower if current state is candidate/leader
+    state.myState = FOLLOWER
+    alarm := AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)} // slightly greater time to receive heartbeat
+    actions = append(actions, alarm)
+    if state.CurrentTerm < event.Term {
+        state.CurrentTerm = event.Term
+        state.VotedFor = -1
+        state_changed_flag = true
+    }
+    state.currentLdr = event.FromId
+    state.lastLeaderContact = time.Now()
+    state.preVoting = false
+
+    if event.LastIncludedIndex <= state.commitIndex {
+        // Already have all the logs of the snapshot, leader resumes appending after our last log
+        state.pendingSnapshot = nil
+        actions = append(actions, SendAction{ToId: event.FromId, Event: InstallSnapshotRespEvent{
+            FromId              : state.server_id,
+            Term                : state.CurrentTerm,
+            LastIncludedIndex   : event.LastIncludedIndex,
+            LastLogIndex        : state.GetLastLogIndex() }})
+        return actions
+    }
+
+    // Chunks of a snapshot are received from a single leader
+    isPending := state.pendingSnapshot != nil &&
+                 state.pendingSnapshot.LastIncludedIndex == event.LastIncludedIndex &&
+                 state.pendingSnapshotFrom == event.FromId
+
+    // Start receiving new snapshot
+    if event.Offset == 0 && !isPending {
+        state.pendingSnapshot = &Snapshot{
+            LastIncludedIndex   : event.LastIncludedIndex,
+            LastIncludedTerm    : event.LastIncludedTerm,
+            Config              : event.Config,
+            Data                : []byte{} }
+        state.pendingSnapshotFrom = event.FromId
+        isPending = true
+    }
+
+    // Ask for the chunk we are expecting, if this one is duplicate or out of order
+    if !isPending {
+        respond(0)
+        return actions
+    } else if event.Offset != int64(len(state.pendingSnapshot.Data)) {
+        respond(int64(len(state.pendingSnapshot.Data)))
+        return actions
+    }
+
+    state.pendingSnapshot.Data = append(state.pendingSnapshot.Data, event.Data...)
+    if !event.Done {
+        respond(int64(len(state.pendingSnapshot.Data)))
+        return actions
+    }
+
+    // Last chunk received, install snapshot
+    snapshot := *state.pendingSnapshot
+    state.pendingSnapshot = nil
+    if err := state.saveSnapshot(snapshot); err != nil {
+        // Logs are kept, leader sends the snapshot again
+        state.log_error(3, "Unable to store snapshot from %v at index %v : %v", event.FromId, snapshot.LastIncludedIndex, err.Error())
+        respond(0)
+        return actions
+    }
+    state.log_info(3, "Installing snapshot from %v at index %v", event.FromId, snapshot.LastIncludedIndex)
+
+    // If we have the last log of the snapshot, logs following it are retained
+    keepTail := snapshot.LastIncludedIndex <= state.GetLastLogIndex() &&
+                state.GetLogAt(snapshot.LastIncludedIndex).Term == snapshot.LastIncludedTerm
+    if !keepTail {
+        // Logs after the snapshot are conflicting, so uncommitted, they are discarded with the log
+        for i := snapshot.LastIncludedIndex + 1; i <= state.GetLastLogIndex(); i++ {
+            action := CommitAction{Index:-1, Data: state.GetLogAt(i).Data, Err: Error_Commit{}}
+            actions = append(actions, action)
+        }
+    }
+
+    // Client replaces its state with the snapshot
+    actions = append(actions, CommitAction{Index: snapshot.LastIncludedIndex, Data: snapshot, Err: nil})
+    actions = append(actions, state.compactLogs(snapshot, keepTail)...)
+    state.snapshot = &snapshot
+
+    respond(int64(len(snapshot.Data)))
+    return actions
+}
+
+/********************************************************************
+ *                                                                  *
+ *                  Install Snapshot Response                       *
+ *                                                                  *
+ ********************************************************************/
+func (state *StateMachine) installSnapshotResponse(event InstallSnapshotRespEvent) (actions []interface{}) {
+    actions = make([]interface{}, 0)
+
+    // Track if persistent state of raft state machine changes
+    state_changed_flag := false
+    // Check and store state on persistent store
+    defer func() {
+        if state_changed_flag {
+            // Prepend StateStore action
+            actions = append(actions, state.GetStateStoreAction())
+        }
+    }()
+
+    // Check term
+    if state.CurrentTerm < event.Term {
+        // This server term is not so up-to-date, so update
+        state.myState = FOLLOWER
+        state.CurrentTerm = event.Term
+        state.VotedFor = -1
+        state_changed_flag = true
+
+        // reset alarm
+        alarm := AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)} // slightly greater time to receive heartbeat
+        actions = append(actions, alarm)
+        return actions
+    }
+
+    if state.myState != LEADER || state.CurrentTerm > event.Term {
+        return actions
+    }
+    state.lastHeard[event.FromId] = time.Now()
+    if _, installing := state.snapshotOffset[event.FromId]; !installing {
+        return actions      // Delayed response, or the node is no longer a member
+    }
+
+    if event.LastIncludedIndex != state.snapshot.LastIncludedIndex {
+        // Snapshot has been replaced by newer one, start over
+        state.snapshotOffset[event.FromId] = 0
+        actions = append(actions, SendAction{ToId: event.FromId, Event: state.getSnapshotChunk(0)})
+    } else if event.LastLogIndex == 0 && event.Offset < int64(len(state.snapshot.Data)) {
+        // Send next chunk
+        state.snapshotOffset[event.FromId] = event.Offset
+        actions = append(actions, SendAction{ToId: event.FromId, Event: state.getSnapshotChunk(event.Offset)})
+    } else {
+        // Snapshot installed or the node already has its logs, continue with the logs after it
+        state.log_info(3, "Snapshot at index %v installed on %v", event.LastIncludedIndex, event.FromId)
+        delete(state.snapshotOffset, event.FromId)
+        if state.matchIndex[event.FromId] < event.LastIncludedIndex {
+            state.matchIndex[event.FromId] = event.LastIncludedIndex
+        }
+        state.nextIndex[event.FromId] = state.matchIndex[event.FromId] + 1
+        if event.LastLogIndex > state.matchIndex[event.FromId] && event.LastLogIndex <= state.GetLastLogIndex() {
+            state.nextIndex[event.FromId] = event.LastLogIndex + 1
+        }
+        actions = append(actions, state.replicateTo(event.FromId)...)
+        actions = append(actions, state.checkTransfer()...)
+    }
+    return actions
+}
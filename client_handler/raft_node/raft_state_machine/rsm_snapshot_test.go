@@ -0,0 +1,45 @@
+package raft_state_machine
+
+import (
+    "os"
+    "testing"
+)
+
+// Follower which has committed the logs of the snapshot answers its first chunk with its
+// last log, and the leader goes back to sending append requests instead of the snapshot
+func TestSnapshot_FollowerHasLogs(t *testing.T) {
+    os.RemoveAll(testLogDir)
+    defer os.RemoveAll(testLogDir)
+
+    leader := makeState(1, logTerms(1, 20))
+    follower := makeState(2, logTerms(1, 15))
+    follower.commitIndex = 10
+    leader.initialiseLeader()
+    leader.snapshot = &Snapshot{LastIncludedIndex: 5, LastIncludedTerm: 1, Data: make([]byte, 3*SNAPSHOT_CHUNKSIZE)}
+    leader.snapshotOffset[2] = 0
+
+    var resp interface{}
+    for _, action := range follower.ProcessEvent(leader.getSnapshotChunk(0)) {
+        if send, ok := action.(SendAction); ok {
+            resp = send.Event
+        }
+    }
+    snapResp, ok := resp.(InstallSnapshotRespEvent)
+    if !ok || snapResp.LastLogIndex != 15 {
+        t.Fatalf("Expected snapshot response with last log index 15, got %+v", resp)
+    }
+
+    for _, action := range leader.ProcessEvent(snapResp) {
+        if send, ok := action.(SendAction); ok {
+            if _, ok := send.Event.(InstallSnapshotEvent); ok {
+                t.Fatalf("Leader kept sending the snapshot")
+            }
+        }
+    }
+    if _, installing := leader.snapshotOffset[2]; installing {
+        t.Fatalf("Leader is still installing the snapshot")
+    }
+    if leader.nextIndex[2] != 16 {
+        t.Fatalf("Next index of the follower is %v, expected 16", leader.nextIndex[2])
+    }
+}
@@ -0,0 +1,118 @@
+package raft_state_machine
+
+import (
+    "fmt"
+    "time"
+)
+
+/*
+ *  Input event : client requests to transfer the leadership to node Id.
+ *  Data is returned back with TransferLeadershipAction, it is not interpreted by the state machine.
+ */
+type TransferLeadershipEvent struct {
+    Id   int
+    Data interface{}
+}
+
+/*
+ *  Sent by the leader to the transfer target, once its logs are up-to-date, to start election immediately
+ */
+type TimeoutNowEvent struct {
+    FromId int
+    Term   int
+}
+
+/*
+ *  Output action : transfer is over, Err == nil if this node is no longer the leader
+ */
+type TransferLeadershipAction struct {
+    Data interface{}
+    Err  error
+}
+
+type Error_Transfer struct {
+    Reason string
+}
+func (err Error_Transfer) Error() string {
+    return "Unable to transfer the leadership : " + err.Reason
+}
+
+/********************************************************************
+ *                                                                  *
+ *                      Leadership transfer                         *
+ *                                                                  *
+ ********************************************************************/
+func (state *StateMachine) transferLeadership(event TransferLeadershipEvent) (actions []interface{}) {
+    actions = []interface{}{}
+
+    reject := func(err error) []interface{} {
+        return append(actions, TransferLeadershipAction{Data: event.Data, Err: err})
+    }
+
+    if state.myState != LEADER {
+        return reject(Error_NotLeader{LeaderId: state.GetCurrentLeader()})
+    } else if state.transferTarget != 0 {
+        return reject(Error_Transfer{Reason: fmt.Sprintf("transfer to %v is in progress", state.transferTarget)})
+    } else if event.Id == state.server_id {
+        return append(actions, TransferLeadershipAction{Data: event.Data, Err: nil})
+    } else if !contains(state.config.New, event.Id) {
+        return reject(Error_Transfer{Reason: fmt.Sprintf("server %v is not a member", event.Id)})
+    }
+
+    // New requests are rejected until the transfer is over, so that target can catch up with the leader
+    state.log_info(3, "Transferring leadership to %v", event.Id)
+    state.transferTarget = event.Id
+    state.transferData = event.Data
+    state.transferDeadline = time.Now().Add(time.Duration(state.ElectionTimeout) * time.Millisecond)
+    // Target's election is not held back by the lease, so reads are no longer served by it
+    state.leaseExpiry = time.Time{}
+
+    actions = append(actions, state.replicateTo(event.Id)...)
+    return append(actions, state.checkTransfer()...)
+}
+
+//  Tells the transfer target to start election, once it has all the logs of the leader
+func (state *StateMachine) checkTransfer() (actions []interface{}) {
+    actions = []interface{}{}
+
+    if state.transferTarget == 0 || state.matchIndex[state.transferTarget] < state.GetLastLogIndex() {
+        return actions
+    }
+
+    timeoutNow := TimeoutNowEvent{FromId: state.server_id, Term: state.CurrentTerm}
+    return append(actions, SendAction{ToId: state.transferTarget, Event: timeoutNow})
+}
+
+//  Ends the transfer, successfully if leadership is lost, or with error if it is still the leader after deadline
+func (state *StateMachine) endTransfer() (actions []interface{}) {
+    actions = []interface{}{}
+
+    if state.transferTarget == 0 {
+        return actions
+    }
+
+    if state.myState != LEADER {
+        state.log_info(3, "Stepped down, leadership transferred to %v", state.transferTarget)
+        actions = append(actions, TransferLeadershipAction{Data: state.transferData, Err: nil})
+    } else if time.Now().After(state.transferDeadline) {
+        reason := fmt.Sprintf("server %v did not take over within election timeout", state.transferTarget)
+        state.log_warning(3, "Transfer failed, %v", reason)
+        actions = append(actions, TransferLeadershipAction{Data: state.transferData, Err: Error_Transfer{Reason: reason}})
+    } else {
+        return actions
+    }
+    state.transferTarget = 0
+    state.transferData = nil
+    return actions
+}
+
+//  Target of the transfer starts election without waiting for election timeout, or pre-vote
+func (state *StateMachine) timeoutNow(event TimeoutNowEvent) (actions []interface{}) {
+    actions = []interface{}{}
+
+    if event.Term != state.CurrentTerm || state.myState == LEADER || !state.config.contains(state.server_id) {
+        return actions      // Stale request
+    }
+    state.log_info(3, "Leadership transfer requested by %v, starting election", event.FromId)
+    return state.startElection(true)
+}
@@ -6,6 +6,7 @@ import (
     "math/rand"
     "strconv"
     "reflect"
+    "time"
     "github.com/avg598/cs733/logging"
 )
 
@@ -57,6 +58,7 @@ type AppendRequestEvent struct {
     PrevLogTerm  int
     Entries      []LogEntry
     LeaderCommit int64
+    Seq          int64 // Heartbeat round confirming leadership for reads, 0 if acknowledgement is not required
 }
 
 type AppendRequestRespEvent struct {
@@ -64,6 +66,9 @@ type AppendRequestRespEvent struct {
     Term         int
     Success      bool
     LastLogIndex int64 // Helps in updating nextIndex & matchIndex
+    Seq          int64 // Seq of the append request acknowledged
+    ConflictTerm  int   // Term of the conflicting log at PrevLogIndex, 0 if the log is missing
+    ConflictIndex int64 // First index of ConflictTerm in follower's log, or its last log index + 1
 }
 
 type RequestVoteEvent struct {
@@ -71,6 +76,7 @@ type RequestVoteEvent struct {
     Term         int
     LastLogIndex int64
     LastLogTerm  int
+    Transfer     bool  // Election started on leader's request, so vote even if the leader is alive
 }
 
 type RequestVoteRespEvent struct {
@@ -79,6 +85,20 @@ type RequestVoteRespEvent struct {
     VoteGranted bool
 }
 
+// Asks whether the vote would be granted for Term, receiver's persistent state is not changed
+type PreVoteEvent struct {
+    FromId       int
+    Term         int   // Term in which the node would start election, its CurrentTerm + 1
+    LastLogIndex int64
+    LastLogTerm  int
+}
+
+type PreVoteRespEvent struct {
+    FromId      int
+    Term        int   // Term of the pre-vote if granted, else current term of the receiver
+    VoteGranted bool
+}
+
 type TimeoutEvent struct {
 }
 
@@ -139,24 +159,67 @@ type StateMachine struct {
     CurrentTerm   int
     VotedFor      int        // -1: not voted
     LastApplied   int64      // Updated by client handler when the log is applied to its state machine
-    numberOfNodes int
+
+                             // Logs up to LastIncludedIndex are compacted into the snapshot
+    LastIncludedIndex int64
+    LastIncludedTerm  int
 
                              // log is initialised with single dummy log, to make life easier in future checking
                              // Index starts from 1, as first empty entry is present
+                             // After compaction, first entry of the log stands for the snapshot, it's index is
+                             // LastIncludedIndex, so log at index i is stored at (i - LastIncludedIndex)
     PersistentLog *log.Log   // Persistent log, used to retrieve logs which are not in memory
+    logDir        string     // Directory of persistent logs, state and snapshot of this node
+    snapshot      *Snapshot  // Latest snapshot, nil if not taken yet
+    pendingSnapshot     *Snapshot   // Snapshot being received from the leader
+    pendingSnapshotFrom int         // Id of the leader sending pendingSnapshot
+
+                             // Configuration of the cluster, latest configuration in the log is active
+    config        ConfigEntry
+    configIndex   int64       // Index of the log carrying active configuration
+    baseConfig    ConfigEntry // Configuration as of LastIncludedIndex, active if logs carry no configuration
 
                              // Non-persistent state
     server_id     int
     commitIndex   int64      // initialised to 0
-    nextIndex   []int64      // Using first 0th dummy entry for all arrays
-    matchIndex  []int64      // Using first 0th dummy entry for all arrays
+    nextIndex     map[int]int64 // Maintained by leader for the members of active configuration
+    matchIndex    map[int]int64 // Maintained by leader for the members of active configuration
     myState       RaftState  // CANDIDATE/FOLLOWER/LEADER, this server state {candidate, follower, leader}
     currentLdr    int        // Id of the current leader, used to redirect client to the leader
 
                              // maintain received votes from other nodes,
                              // if vote received, set corresponding value to term for which the vote has received
                              // -ve value represents negative vote
-    receivedVote []int       // Using first 0th dummy entry for all arrays
+    receivedVote map[int]int
+
+                             // Pre-vote round, node remains follower until majority would grant the vote
+    preVoting     bool
+    preVotes      map[int]bool
+
+                             // Offset of the next snapshot chunk to be sent to the node,
+                             // present only for the nodes to which leader is sending its snapshot
+    snapshotOffset map[int]int64
+
+                             // CheckQuorum, leader steps down if majority has not responded within an election timeout
+    lastHeard     map[int]time.Time // Last time the node responded to the leader
+    quorumCheckAt time.Time         // Start of current check window
+
+                             // Linearizable reads waiting for leadership confirmation
+    pendingReads  []pendingRead
+    heartbeatSeq  int64         // Latest heartbeat round started by the leader
+    ackedSeq      map[int]int64 // Latest heartbeat round acknowledged by the node
+
+                             // Leader lease, reads are served without heartbeat round until leaseExpiry
+    leaseRead         bool
+    leaseDuration     time.Duration       // ElectionTimeout minus bound on clock drift
+    leaseExpiry       time.Time
+    seqSentAt         map[int64]time.Time // Start time of heartbeat rounds, not yet acknowledged by majority
+    lastLeaderContact time.Time           // Last time a message from current leader was received
+
+                             // Leadership transfer in progress, 0 if none
+    transferTarget   int
+    transferData     interface{}    // Returned with TransferLeadershipAction
+    transferDeadline time.Time      // Transfer fails if leadership is not lost until then
 
                              // Timeouts in milliseconds
     ElectionTimeout  int
@@ -182,7 +245,9 @@ func (state *StateMachine) GetStateStoreAction() StateStore {
         ElectionTimeout     : state.ElectionTimeout,
         HeartbeatTimeout    : state.HeartbeatTimeout,
         CurrentTerm         : state.CurrentTerm,
-        VotedFor            : state.VotedFor }
+        VotedFor            : state.VotedFor,
+        LastIncludedIndex   : state.LastIncludedIndex,
+        LastIncludedTerm    : state.LastIncludedTerm }
     return StateStore{State:server_copy}
 }
 
@@ -191,11 +256,11 @@ func (state *StateMachine) GetStateStoreAction() StateStore {
  */
 //  Returns last log entry
 func (state *StateMachine) getLastLog() *LogEntry {
-    log := state.GetLogAt(state.PersistentLog.GetLastIndex())
+    log := state.GetLogAt(state.GetLastLogIndex())
     return log
 }
 func (state *StateMachine) GetLastLogIndex() int64 {
-    return state.PersistentLog.GetLastIndex()
+    return state.PersistentLog.GetLastIndex() + state.LastIncludedIndex
 }
 func (state *StateMachine) GetLastLogTerm() int {
     log, _ := state.PersistentLog.Get(state.PersistentLog.GetLastIndex())
@@ -203,9 +268,9 @@ func (state *StateMachine) GetLastLogTerm() int {
 }
 //  Return log of given index
 func (state *StateMachine)GetLogAt(index int64) *LogEntry {
-    l, e := state.PersistentLog.Get(index)
+    l, e := state.PersistentLog.Get(index - state.LastIncludedIndex)
     if e!=nil {
-        state.log_error(5, "Persistent log access error : %v : last index:%v  | accessed index:%v", e.Error(), state.PersistentLog.GetLastIndex(), index)
+        state.log_error(5, "Persistent log access error : %v : last index:%v  | accessed index:%v | last included index:%v", e.Error(), state.GetLastLogIndex(), index, state.LastIncludedIndex)
         panic("PANNICING") // TODO:: for leveldb: not found error, because the key doesn't exist in leveldb
         return nil
     }
@@ -217,9 +282,9 @@ func (state *StateMachine)GetLogAt(index int64) *LogEntry {
 func (state *StateMachine)getLogsFrom(index int64) *[]LogEntry {
     logs := []LogEntry{}
 
-    for ; index <= state.PersistentLog.GetLastIndex() ; index++ {
+    for ; index <= state.GetLastLogIndex() ; index++ {
         //state.log_info(4, "Fetching %v th log from persistent store", index)
-        l, e := state.PersistentLog.Get(int64(index))
+        l, e := state.PersistentLog.Get(index - state.LastIncludedIndex)
         if e!=nil {
             state.log_error(4, "Persistent log access error : %v", e.Error())
             return nil
@@ -239,7 +304,7 @@ func (state *StateMachine)getLogsFrom(index int64) *[]LogEntry {
 func (state *StateMachine)truncateLogsFrom(index int64) *[]LogEntry {
     logs := state.getLogsFrom(index)
 
-    err := state.PersistentLog.TruncateToEnd(index)
+    err := state.PersistentLog.TruncateToEnd(index - state.LastIncludedIndex)
     if err != nil {
         state.log_error(4, "Error while truncating persistent logs : %v", err.Error())
     }
@@ -258,18 +323,19 @@ func (state *StateMachine) GetCurrentTerm() int {
 func (state *StateMachine) GetServerId() int {
     return state.server_id
 }
-func (state *StateMachine) GetNumberOfNodes() int {
-    return state.numberOfNodes
-}
 func (state *StateMachine) GetCurrentLeader() int {
     return state.currentLdr
 }
 
-// Broadcast an event, returns array of actions
+// Broadcast an event to the members and learners of active configuration, returns array of actions
 func (state *StateMachine) broadcast(event interface{}) (actions []interface{}) {
     actions = make([]interface{}, 0)
-    action := SendAction{ToId: -1, Event: event} // Sending to -1, -1 is for broadcast
-    actions = append(actions, action)
+    for _, id := range state.config.peers() {
+        if id != state.server_id {
+            action := SendAction{ToId: id, Event: event}
+            actions = append(actions, action)
+        }
+    }
     return actions
 }
 
@@ -277,15 +343,43 @@ func (state *StateMachine) broadcast(event interface{}) (actions []interface{})
 func (state *StateMachine) initialiseLeader() {
     // become leader
     state.myState = LEADER
-    state.matchIndex = make([]int64, state.numberOfNodes+1)
-    state.nextIndex = make([]int64, state.numberOfNodes+1)
-    state.matchIndex[state.server_id] = state.GetLastLogIndex()
+    state.matchIndex = make(map[int]int64)
+    state.nextIndex = make(map[int]int64)
     state.currentLdr = state.GetServerId()  // update current leader
+    state.snapshotOffset = make(map[int]int64)
+    state.ackedSeq = make(map[int]int64)
+    state.seqSentAt = make(map[int64]time.Time)
+    state.leaseExpiry = time.Time{}
+    state.lastHeard = make(map[int]time.Time)
+    state.quorumCheckAt = time.Now()
 
     // initialise nextIndex
-    for i := 0; i <= state.numberOfNodes; i++ {
-        state.nextIndex[i] = state.GetLastLogIndex() + 1
+    state.trackPeers()
+    state.matchIndex[state.server_id] = state.GetLastLogIndex()
+}
+
+// Returns true if majority has responded to the leader in current check window
+func (state *StateMachine) hasQuorumContact() bool {
+    return state.isQuorum(func(id int) bool {
+        return id == state.server_id || state.lastHeard[id].After(state.quorumCheckAt)
+    })
+}
+
+// Leader steps down when it lost contact with majority, requests not yet committed
+// fail fast instead of waiting for replication which might never happen. They stay in the
+// log and may still be committed by the next leader, so they fail as not leader, to be retried
+func (state *StateMachine) stepDown() (actions []interface{}) {
+    actions = make([]interface{}, 0)
+
+    state.log_warning(3, "Majority has not responded within election timeout, stepping down")
+    state.myState = FOLLOWER
+    state.currentLdr = 0
+    for i := state.commitIndex + 1; i <= state.GetLastLogIndex(); i++ {
+        action := CommitAction{Index:-1, Data: state.GetLogAt(i).Data, Err: Error_NotLeader{}}
+        actions = append(actions, action)
     }
+    actions = append(actions, AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)})
+    return actions
 }
 
 /********************************************************************
@@ -297,18 +391,16 @@ func (state *StateMachine) timeout(event TimeoutEvent) (actions []interface{}) {
 
     actions = make([]interface{}, 0)
 
-    // Track if persistent state of raft state machine changes
-    state_changed_flag := false
-    // Check and store state on persistent store
-    defer func() {
-        if state_changed_flag {
-            // Prepend StateStore action
-            actions = append(actions, state.GetStateStoreAction())
-        }
-    }()
-
     switch state.myState {
     case LEADER:
+        // Check once in an election timeout that the leader is still in contact with majority
+        if time.Since(state.quorumCheckAt) >= time.Duration(state.ElectionTimeout) * time.Millisecond {
+            if !state.hasQuorumContact() {
+                return state.stepDown()
+            }
+            state.quorumCheckAt = time.Now()
+        }
+
         // Send empty appendRequests
 
         heartbeatEvent := AppendRequestEvent{
@@ -318,28 +410,36 @@ func (state *StateMachine) timeout(event TimeoutEvent) (actions []interface{}) {
             PrevLogTerm:  state.GetLastLogTerm(),
             Entries:      []LogEntry{},
             LeaderCommit: state.commitIndex}
+        if state.leaseRead {
+            heartbeatEvent.Seq = state.newHeartbeatRound()  // Acknowledgements renew the lease
+        } else if len(state.pendingReads) > 0 {
+            heartbeatEvent.Seq = state.heartbeatSeq      // Acknowledgements might have been lost
+        }
         heartbeatActions := state.broadcast(heartbeatEvent) // broadcast request vote event
         actions = append(actions, heartbeatActions...)
-        actions = append(actions, AlarmAction{Time: state.HeartbeatTimeout})
+
+        // Resend snapshot chunks, in case they are lost
+        for id, offset := range state.snapshotOffset {
+            actions = append(actions, SendAction{ToId: id, Event: state.getSnapshotChunk(offset)})
+        }
+        // Complete configuration change left by previous leader
+        actions = append(actions, state.advanceConfig()...)
+        if state.myState == LEADER {
+            actions = append(actions, AlarmAction{Time: state.HeartbeatTimeout})
+        }
     case CANDIDATE:
-        // Restart election
+        // Restart election, again after pre-vote
         fallthrough
     case FOLLOWER:
-        // Start election
-        state.myState = CANDIDATE
-        state.CurrentTerm = state.CurrentTerm + 1
-        state.VotedFor = state.server_id
-        state_changed_flag = true
-        actions = append(actions, AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)})
-        state.receivedVote[state.server_id] = state.CurrentTerm // voting to self
-
-        voteReq := RequestVoteEvent{
-            FromId:       state.server_id,
-            Term:         state.CurrentTerm,
-            LastLogIndex: state.GetLastLogIndex(),
-            LastLogTerm:  state.GetLastLogTerm()}
-        voteReqActions := state.broadcast(voteReq) // broadcast request vote event
-        actions = append(actions, voteReqActions...)
+        if !state.config.contains(state.server_id) {
+            // Not a member of the cluster, wait until leader adds this node
+            state.myState = FOLLOWER
+            actions = append(actions, AlarmAction{Time: state.ElectionTimeout + rand.Intn(state.ElectionTimeout)})
+            return actions
+        }
+
+        // Election is started only if majority would vote, so that a partitioned node does not bump the term
+        actions = append(actions, state.startPreVote()...)
     }
     return actions
 }
@@ -349,9 +449,16 @@ func (state *StateMachine) timeout(event TimeoutEvent) (actions []interface{}) {
  *                          Process event                           *
  *                                                                  *
  ********************************************************************/
-func (state *StateMachine) ProcessEvent(event interface{}) []interface{} {
+func (state *StateMachine) ProcessEvent(event interface{}) (actions []interface{}) {
     // Initialise the variables and timeout
 
+    // Reads waiting for leadership confirmation fail, if the event takes away the leadership
+    // and leadership transfer ends
+    defer func() {
+        actions = append(actions, state.abortReads()...)
+        actions = append(actions, state.endTransfer()...)
+    }()
+
     switch event.(type) {
     case AppendRequestEvent:
         return state.appendRequest(event.(AppendRequestEvent))
@@ -361,10 +468,28 @@ func (state *StateMachine) ProcessEvent(event interface{}) []interface{} {
         return state.voteRequest(event.(RequestVoteEvent))
     case RequestVoteRespEvent:
         return state.voteRequestResponse(event.(RequestVoteRespEvent))
+    case PreVoteEvent:
+        return state.preVoteRequest(event.(PreVoteEvent))
+    case PreVoteRespEvent:
+        return state.preVoteResponse(event.(PreVoteRespEvent))
     case TimeoutEvent:
         return state.timeout(event.(TimeoutEvent))
     case *[]AppendEvent:
         return state.appendClientRequest(event.(*[]AppendEvent))
+    case SnapshotEvent:
+        return state.takeSnapshot(event.(SnapshotEvent))
+    case InstallSnapshotEvent:
+        return state.installSnapshot(event.(InstallSnapshotEvent))
+    case InstallSnapshotRespEvent:
+        return state.installSnapshotResponse(event.(InstallSnapshotRespEvent))
+    case AddServerEvent, RemoveServerEvent, AddLearnerEvent, PromoteLearnerEvent:
+        return state.changeConfig(event)
+    case ReadIndexEvent:
+        return state.readIndex(event.(ReadIndexEvent))
+    case TransferLeadershipEvent:
+        return state.transferLeadership(event.(TransferLeadershipEvent))
+    case TimeoutNowEvent:
+        return state.timeoutNow(event.(TimeoutNowEvent))
     default:
         state.log_error(3, "Invalid event type %+v", reflect.TypeOf(event))
         return nil
@@ -6,6 +6,7 @@ import (
     "fmt"
     "strconv"
     "path"
+    "time"
     "github.com/cs733-iitb/log"
     "github.com/avg598/cs733/raft_config"
 )
@@ -44,50 +45,76 @@ func (state *StateMachine) ToServerStateFile(serverStateFile string) (err error)
 }
 
 /*****
- *      Create and initialise state machine state
+ *      Create and initialise state machine state, without persistent log
  *
  *
  */
-func New(Id int, config *raft_config.Config) (server *StateMachine) {
+func newState(Id int, config *raft_config.Config) (server *StateMachine) {
+
+    // Initial configuration consists of nodes 1 to NumOfNodes and learners, others join through configuration change
+    members := []int{}
+    for i := 1; i <= config.NumOfNodes; i++ {
+        members = append(members, i)
+    }
 
     server = &StateMachine{
         server_id       : Id,
         CurrentTerm     : 0,
         VotedFor        : -1,
-        numberOfNodes   : config.NumOfNodes,
         PersistentLog   : nil,
         commitIndex     : 0,
         LastApplied     : 0,
-        nextIndex       : make([]int64, config.NumOfNodes+1),
-        matchIndex      : make([]int64, config.NumOfNodes+1),
-        receivedVote    : make([]int, config.NumOfNodes+1),
+        baseConfig      : ConfigEntry{New: members, Learners: append([]int{}, config.Learners...)},
+        nextIndex       : make(map[int]int64),
+        matchIndex      : make(map[int]int64),
+        receivedVote    : make(map[int]int),
         myState         : FOLLOWER,
         currentLdr      : Id,    // imposing that current leader is self
         ElectionTimeout : config.ElectionTimeout,
-        HeartbeatTimeout: config.HeartbeatTimeout}
+        HeartbeatTimeout: config.HeartbeatTimeout,
+        logDir          : path.Clean(config.LogDir + "/raft_" + strconv.Itoa(Id) + "/")}
+    server.config = server.baseConfig
 
-    // Open persistent log
-    logPath := path.Clean(config.LogDir + "/raft_" + strconv.Itoa(Id) + "/")
-    server.log_info(3, "Opening raft logs : %v", logPath + "/")
-    lg, err := log.Open(logPath)
-    if err != nil {
-        server.log_error(3, "Unable to open raft logs : %v", err)
-        fmt.Printf("Unable to open raft logs : %v\n", err)
-        os.Exit(2)
+    if config.LeaseRead {
+        server.leaseRead = true
+        server.leaseDuration = time.Duration(config.ElectionTimeout - config.LeaseDriftBound) * time.Millisecond
+        if server.leaseDuration <= 0 {
+            server.log_warning(3, "Drift bound %v exceeds election timeout, lease reads are disabled", config.LeaseDriftBound)
+            server.leaseRead = false
+        }
     }
 
-    lg.SetCacheSize(1000000)    // TODO:: out of cache logs are not accessible
-    lg.RegisterSampleEntry(LogEntry{})      //  Problem might be this
+    return server
+}
+
+/*****
+ *      Create and initialise state machine state with empty persistent log
+ *
+ *
+ */
+func New(Id int, config *raft_config.Config) (server *StateMachine) {
+    server = newState(Id, config)
 
-    server.PersistentLog = lg
+    server.PersistentLog = server.openLog(server.logPath(0))
     server.PersistentLog.Append(LogEntry{Index:0, Term:0, Data:"Dummy Entry"})
+    server.updateConfig()
 
-    for i := 0; i <= config.NumOfNodes; i++ {
-        server.nextIndex[i] = 1  // Set to index of next log to send
-        server.matchIndex[i] = 0 // Set to last log index on that server, increases monotonically
+    return server
+}
+
+// Open persistent log at given path
+func (state *StateMachine) openLog(logPath string) *log.Log {
+    state.log_info(3, "Opening raft logs : %v", logPath + "/")
+    lg, err := log.Open(logPath)
+    if err != nil {
+        state.log_error(3, "Unable to open raft logs : %v", err)
+        fmt.Printf("Unable to open raft logs : %v\n", err)
+        os.Exit(2)
     }
 
-    return server
+    lg.SetCacheSize(1000000)    // Out of cache logs are not accessible, log compaction keeps the log within the cache
+    lg.RegisterSampleEntry(LogEntry{})      //  Problem might be this
+    return lg
 }
 
 /*****
@@ -105,12 +132,35 @@ func Restore(Id int, config *raft_config.Config) (state *StateMachine) {
     }
 
     // Copy persistent state variables to newly initialized state
-    new_state              := New(Id, config)
-    new_state.CurrentTerm   = restored_state.CurrentTerm
-    new_state.VotedFor      = restored_state.VotedFor
-    new_state.LastApplied   = restored_state.LastApplied
-    new_state.commitIndex   = restored_state.LastApplied
+    new_state                  := newState(Id, config)
+    new_state.CurrentTerm       = restored_state.CurrentTerm
+    new_state.VotedFor          = restored_state.VotedFor
+    new_state.LastApplied       = restored_state.LastApplied
+    new_state.commitIndex       = restored_state.LastApplied
+    new_state.LastIncludedIndex = restored_state.LastIncludedIndex
+    new_state.LastIncludedTerm  = restored_state.LastIncludedTerm
+    if new_state.LastApplied < new_state.LastIncludedIndex {
+        // Logs up to the snapshot are applied, even if the stored last applied lags behind it
+        new_state.LastApplied = new_state.LastIncludedIndex
+        new_state.commitIndex = new_state.LastIncludedIndex
+    }
+
+    // Load snapshot, logs before the snapshot are already discarded
+    snapshotPath := path.Clean(new_state.logDir + "/" + SnapshotFile)
+    new_state.snapshot, err = FromSnapshotFile(snapshotPath)
+    if err != nil {
+        fmt.Printf("Unable to restore snapshot : %v\n", err.Error())
+        os.Exit(2)
+    }
+    if new_state.LastIncludedIndex > 0 && new_state.snapshot == nil {
+        fmt.Printf("Snapshot at index %v is missing\n", new_state.LastIncludedIndex)
+        os.Exit(2)
+    }
+    if new_state.snapshot != nil {
+        new_state.baseConfig = new_state.snapshot.Config
+    }
 
-    new_state.PersistentLog.TruncateToEnd(new_state.PersistentLog.GetLastIndex())   // removing dummy entry appended in New(config)
+    new_state.PersistentLog = new_state.openLog(new_state.logPath(new_state.LastIncludedIndex))
+    new_state.updateConfig()
     return new_state
 }
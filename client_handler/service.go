@@ -0,0 +1,90 @@
+package client_handler
+
+import (
+    "errors"
+    "time"
+)
+
+var ErrTimeout  = errors.New("Request not committed before timeout")
+var ErrShutdown = errors.New("Client handler is shut down")
+
+/*
+ *  Service replicated by raft, e.g. the file system. Client handler applies the committed
+ *  requests to it in log order, and captures/restores it in snapshots.
+ *  Types of the requests must be registered to gob, as they are carried in raft logs.
+ */
+type Service interface {
+    Apply(index int64, at time.Time, data interface{}) interface{}  // Apply committed request at log index, at the time assigned
+                                                                    // to it by the leader, returns the response
+    Snapshot() ([]byte, error)                          // Serialise the state of the service
+    Restore(data []byte) error                          // Replace the state with the one serialised by Snapshot
+}
+
+/*
+ *  Response to the replicated request, sent to the thread waiting on it
+ */
+type result struct {
+    Response interface{}
+    Err      error
+}
+
+/***
+ *  Replicate the request and wait until it is applied to the service of this server
+ *  # data      : Request to be applied to the service
+ *  Returns the response of the service, or rsm.Error_NotLeader, rsm.Error_Commit, ErrTimeout, ErrShutdown
+ */
+func (chd *ClientHandler) Submit(data interface{}) (interface{}, error) {
+    return chd.SubmitSession(0, 0, data)
+}
+
+/***
+ *  Replicate the request of the client session and wait until it is applied. Request is applied
+ *  only once, a retry with the same sequence number is answered with the response of the first one
+ *  # clientId  : Unique id of the client, 0 if the request is not part of a session
+ *  # seq       : Sequence number of the request, increasing for every new request of the client
+ */
+func (chd *ClientHandler) SubmitSession(clientId int64, seq int64, data interface{}) (interface{}, error) {
+    reqId, waitChan := chd.RegisterRequest()
+
+    // Send request to replicate
+    request := Request{ServerId:chd.Raft.GetId(), ReqId:reqId, ClientId:clientId, Seq:seq, Time:time.Now(), Data:data}
+    chd.Raft.Append(request)
+
+    // Wait for replication to happen
+    select {
+    case res, ok := <-waitChan:
+        if !ok {
+            return nil, ErrShutdown                 // Deregistered by shutdown
+        }
+        chd.DeregisterRequest(reqId)
+        return res.Response, res.Err
+    case <-time.After(CONNECTION_TIMEOUT):
+        chd.DeregisterRequest(reqId)
+        return nil, ErrTimeout
+    }
+}
+
+/***
+ *  Wait until the service has applied all the requests committed before the call, so that
+ *  reads served by the service after it are linearizable. Served only by the leader.
+ *  Returns rsm.Error_NotLeader if this server is not the leader
+ */
+func (chd *ClientHandler) Sync() error {
+    index, err := chd.Raft.ReadIndex(CONNECTION_TIMEOUT)
+    if err != nil {
+        return err
+    }
+
+    // Wait until the service catches up with the read index
+    chd.appliedLock.Lock()
+    defer chd.appliedLock.Unlock()
+    for chd.lastApplied < index {
+        select {
+        case <-chd.shutDownChan:
+            return ErrShutdown
+        default:
+        }
+        chd.appliedCond.Wait()
+    }
+    return nil
+}
@@ -0,0 +1,112 @@
+package client_handler
+
+import (
+    "bytes"
+    "encoding/gob"
+    "errors"
+    "sort"
+    "time"
+)
+
+var ErrDuplicate = errors.New("Request is older than the last request of the client")
+
+/*
+ *  Last request of the client applied to the service, along with its response. Sessions are
+ *  part of the replicated state, so every server answers a retried request the same way.
+ */
+type session struct {
+    ClientId   int64
+    Seq        int64          // Sequence number of the last applied request
+    Response   interface{}    // Response of the service to it
+    LastActive time.Time      // Time of the last request, assigned by the leader
+}
+
+/*
+ *  Snapshot of the client handler, sessions are captured along with the service
+ */
+type snapshotImage struct {
+    Sessions []session      // Sorted by client id, so that same state results in same snapshot
+    Service  []byte
+}
+
+/***
+ *  Apply the request to the service, unless it has already been applied.
+ *  A retried request is answered with the cached response, instead of being applied again
+ */
+func (chd *ClientHandler) apply(index int64, request Request) (interface{}, error) {
+    // Checked at the same logs, against the same times, by every server
+    if index % SESSION_EVICT_INTERVAL == 0 && !request.Time.IsZero() {
+        chd.evictSessions(request.Time)
+    }
+
+    if request.ClientId == 0 {                          // Not part of a session
+        return chd.Service.Apply(index, request.Time, request.Data), nil
+    }
+
+    last, ok := chd.sessions[request.ClientId]
+    if ok && request.Seq == last.Seq {
+        chd.log_info(3, "Duplicate request %v of client %v, replying with cached response", request.Seq, request.ClientId)
+        return last.Response, nil
+    } else if ok && request.Seq < last.Seq {
+        return nil, ErrDuplicate                        // Client has moved on, nobody waits for it
+    }
+
+    response := chd.Service.Apply(index, request.Time, request.Data)
+    chd.sessions[request.ClientId] = session{ClientId: request.ClientId, Seq: request.Seq, Response: response, LastActive: request.Time}
+    return response, nil
+}
+
+/***
+ *  Forget the sessions without requests for SESSION_TIMEOUT before now. A retry arriving
+ *  after that is applied as a new request
+ */
+func (chd *ClientHandler) evictSessions(now time.Time) {
+    for clientId, s := range chd.sessions {
+        if now.Sub(s.LastActive) > SESSION_TIMEOUT {
+            delete(chd.sessions, clientId)
+        }
+    }
+}
+
+/***
+ *  Serialise the sessions and the state of the service
+ */
+func (chd *ClientHandler) snapshot() ([]byte, error) {
+    data, err := chd.Service.Snapshot()
+    if err != nil {
+        return nil, err
+    }
+
+    image := snapshotImage{Sessions: make([]session, 0, len(chd.sessions)), Service: data}
+    for _, s := range chd.sessions {
+        image.Sessions = append(image.Sessions, s)
+    }
+    sort.Slice(image.Sessions, func(i, j int) bool {
+        return image.Sessions[i].ClientId < image.Sessions[j].ClientId
+    })
+
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(image); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+/***
+ *  Replace the sessions and the state of the service with the ones serialised by snapshot
+ */
+func (chd *ClientHandler) restore(data []byte) error {
+    var image snapshotImage
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&image); err != nil {
+        return err
+    }
+    if err := chd.Service.Restore(image.Service); err != nil {
+        return err
+    }
+
+    chd.sessions = make(map[int64]session, len(image.Sessions))
+    for _, s := range image.Sessions {
+        chd.sessions[s.ClientId] = s
+    }
+    return nil
+}
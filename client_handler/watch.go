@@ -0,0 +1,50 @@
+package client_handler
+
+import (
+    "bufio"
+    "io"
+    "io/ioutil"
+    "net"
+    "github.com/avg598/cs733/client_handler/filesystem/fs"
+)
+
+/***
+ *  Push the events of the watched files to the client, as this server applies the changes.
+ *  Any server serves the watch, all of them apply the same changes at the same versions.
+ *  Returns when the client closes the connection, the watcher falls behind or on shutdown
+ */
+func (chd *ClientHandler) serveWatch(conn *net.TCPConn, reader *bufio.Reader, msg *fs.Msg) {
+    watcher, response := chd.FS.Watch(msg.Filename, msg.Version)
+    if !chd.replyToClient(conn, response) || watcher == nil {
+        return
+    }
+    defer chd.FS.Unwatch(watcher)
+
+    // Client sends nothing more, reading only detects the close of the connection
+    closed := make(chan struct{})
+    go func() {
+        io.Copy(ioutil.Discard, reader)
+        close(closed)
+    }()
+
+    for {
+        select {
+        case <-watcher.Ready:
+            events, ok := watcher.Next()
+            for _, event := range events {
+                if _, err := io.WriteString(conn, event.String() + "\r\n"); err != nil {
+                    chd.log_info(3, "Watch of %v closed : %v", msg.Filename, err)
+                    return
+                }
+            }
+            if !ok {
+                chd.log_info(3, "Watch of %v closed by the file system", msg.Filename)
+                return
+            }
+        case <-closed:
+            return
+        case <-chd.shutDownChan:
+            return
+        }
+    }
+}
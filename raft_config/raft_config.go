@@ -12,11 +12,17 @@ type Config struct {
     ElectionTimeout  int
     HeartbeatTimeout int
     NumOfNodes       int
+    Learners         []int  // Non-voting members of initial configuration, besides nodes 1 to NumOfNodes
     ClusterConfig    cluster.Config
 
     // Client handler config
     ClientPorts      []int
     ServerList       []string // 0th server is null
+    SnapshotInterval int64    // Number of applied logs after which a snapshot is taken, 0 disables snapshots
+    ReadMode         string   // Default mode of reads, "stale" (default) or "linearizable"
+    LeaseRead        bool     // Leader serves linearizable reads under lease, without heartbeat round
+    LeaseDriftBound  int      // Bound on clock drift in milliseconds, lease lasts for ElectionTimeout minus this
+    ForwardWrites    bool     // Followers forward writes to the leader, instead of redirecting the client
 }
 
 